@@ -0,0 +1,28 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "github.com/hadyn/goscape/storage"
+)
+
+func main() {
+    if len(os.Args) != 4 {
+        fmt.Fprintf(os.Stderr, "usage: %s <cache directory> <overlay directory> <output directory>\n", os.Args[0])
+        os.Exit(2)
+    }
+
+    overlay, err := storage.OpenOverlay(os.Args[1], os.Args[2])
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "failed to open the overlay: %s\n", err)
+        os.Exit(1)
+    }
+
+    err = overlay.Bake(os.Args[3])
+    overlay.Close()
+
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "failed to bake the overlay: %s\n", err)
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "github.com/hadyn/goscape/storage"
+)
+
+func main() {
+    if len(os.Args) != 2 {
+        fmt.Fprintf(os.Stderr, "usage: %s <cache directory>\n", os.Args[0])
+        os.Exit(2)
+    }
+
+    s, err := storage.OpenStorage(os.Args[1], storage.ReadOnly)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "failed to open the cache: %s\n", err)
+        os.Exit(1)
+    }
+
+    corruptions, err := s.Verify()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "failed to verify the cache: %s\n", err)
+        os.Exit(1)
+    }
+
+    for _, corruption := range corruptions {
+        fmt.Println(corruption.Error())
+    }
+
+    if len(corruptions) > 0 {
+        fmt.Fprintf(os.Stderr, "found %d corrupt entries\n", len(corruptions))
+        os.Exit(1)
+    }
+
+    fmt.Println("no corruption found")
+}
@@ -0,0 +1,143 @@
+package container
+
+import (
+    "errors"
+    "fmt"
+    "github.com/hadyn/goscape/types"
+)
+
+var (
+    MalformedArchiveError = errors.New("malformed archive")
+)
+
+// Archive is a group that contains one or more child files. When a group has more than one
+// child, the files are split into chunks and a trailer is appended which holds the delta
+// encoded length of each file within each chunk followed by the number of chunks.
+type Archive struct {
+    Files [][]byte
+}
+
+// DecodeArchive splits an unpacked group into its child files.
+func DecodeArchive(buffer []byte, count int) (*Archive, error) {
+    if count < 1 {
+        return nil, errors.New(fmt.Sprintf("invalid child count: %d", count))
+    }
+
+    if count == 1 {
+        return &Archive{Files: [][]byte{buffer}}, nil
+    }
+
+    if len(buffer) < 1 {
+        return nil, MalformedArchiveError
+    }
+
+    chunks := int(buffer[len(buffer)-1])
+    trailer := len(buffer) - 1 - chunks*count*4
+    if chunks < 1 || trailer < 0 {
+        return nil, MalformedArchiveError
+    }
+
+    // Determine the length of each file within each chunk.
+    lengths := make([][]int, chunks)
+    totals := make([]int, count)
+    position := trailer
+    data := 0
+    for chunk := 0; chunk < chunks; chunk++ {
+        lengths[chunk] = make([]int, count)
+        length := 0
+        for file := 0; file < count; file++ {
+            length += int(int32(types.BigEndian.Uint32(buffer[position:])))
+            position += 4
+
+            if length < 0 {
+                return nil, MalformedArchiveError
+            }
+
+            lengths[chunk][file] = length
+            totals[file] += length
+            data += length
+        }
+    }
+
+    if data > trailer {
+        return nil, MalformedArchiveError
+    }
+
+    files := make([][]byte, count)
+    for file := range files {
+        files[file] = make([]byte, 0, totals[file])
+    }
+
+    offset := 0
+    for chunk := 0; chunk < chunks; chunk++ {
+        for file := 0; file < count; file++ {
+            length := lengths[chunk][file]
+            files[file] = append(files[file], buffer[offset:offset+length]...)
+            offset += length
+        }
+    }
+
+    return &Archive{Files: files}, nil
+}
+
+// Encode packs the child files into a single group, splitting each file across the
+// given number of chunks.
+func (a *Archive) Encode(chunks int) ([]byte, error) {
+    if len(a.Files) < 1 {
+        return nil, errors.New("archive has no files")
+    }
+
+    if len(a.Files) == 1 {
+        return a.Files[0], nil
+    }
+
+    if chunks < 1 || chunks > 0xFF {
+        return nil, errors.New(fmt.Sprintf("invalid chunk count: %d", chunks))
+    }
+
+    count := len(a.Files)
+
+    // Determine the length of each file within each chunk.
+    lengths := make([][]int, chunks)
+    for chunk := range lengths {
+        lengths[chunk] = make([]int, count)
+    }
+
+    data := 0
+    for file, contents := range a.Files {
+        remaining := len(contents)
+        for chunk := 0; chunk < chunks; chunk++ {
+            length := remaining / (chunks - chunk)
+            lengths[chunk][file] = length
+            remaining -= length
+        }
+        data += len(contents)
+    }
+
+    result := make([]byte, data+chunks*count*4+1)
+
+    offsets := make([]int, count)
+    position := 0
+    for chunk := 0; chunk < chunks; chunk++ {
+        for file, contents := range a.Files {
+            length := lengths[chunk][file]
+            copy(result[position:], contents[offsets[file]:offsets[file]+length])
+            offsets[file] += length
+            position += length
+        }
+    }
+
+    for chunk := 0; chunk < chunks; chunk++ {
+        last := 0
+        for file := 0; file < count; file++ {
+            length := lengths[chunk][file]
+            types.BigEndian.PutUint32(result[position:], uint32(int32(length-last)))
+            last = length
+            position += 4
+        }
+    }
+
+    result[position] = byte(chunks)
+
+    return result, nil
+}
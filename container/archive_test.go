@@ -0,0 +1,62 @@
+package container
+
+import (
+    "testing"
+    "bytes"
+)
+
+func TestDecodeArchive(t *testing.T) {
+    buffer := []byte{
+        'a', 'b', 'c', 'd', 'e', // Chunk data
+        0, 0, 0, 2, 0, 0, 0, 1, // Chunk lengths (2, 3)
+        1,                      // Chunk count
+    }
+
+    archive, err := DecodeArchive(buffer, 2)
+    if err != nil {
+        t.Fatalf("failed to decode the archive: %s", err)
+    }
+
+    if !bytes.Equal(archive.Files[0], []byte("ab")) || !bytes.Equal(archive.Files[1], []byte("cde")) {
+        t.Error("bytes mismatch")
+    }
+
+    encoded, err := archive.Encode(1)
+    if err != nil {
+        t.Fatalf("failed to encode the archive: %s", err)
+    }
+
+    if !bytes.Equal(encoded, buffer) {
+        t.Error("encoded bytes mismatch")
+    }
+}
+
+func TestArchiveRoundTripChunks(t *testing.T) {
+    archive := &Archive{Files: [][]byte{
+        []byte("Hello world!"),
+        []byte(""),
+        []byte("The quick brown fox jumps over the lazy dog"),
+    }}
+
+    encoded, err := archive.Encode(4)
+    if err != nil {
+        t.Fatalf("failed to encode the archive: %s", err)
+    }
+
+    decoded, err := DecodeArchive(encoded, len(archive.Files))
+    if err != nil {
+        t.Fatalf("failed to decode the archive: %s", err)
+    }
+
+    for i, file := range archive.Files {
+        if !bytes.Equal(decoded.Files[i], file) {
+            t.Errorf("file %d bytes mismatch", i)
+        }
+    }
+}
+
+func TestDecodeArchiveMalformed(t *testing.T) {
+    if _, err := DecodeArchive([]byte{0, 0, 0, 9, 0, 0, 0, 0, 1}, 2); err != MalformedArchiveError {
+        t.Errorf("expected malformed archive error, got: %v", err)
+    }
+}
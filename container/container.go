@@ -3,7 +3,9 @@ package container
 import (
     "io"
     "compress/gzip"
+    "encoding/binary"
     "github.com/dsnet/compress/bzip2"
+    "github.com/ulikunitz/xz/lzma"
     "bytes"
     "github.com/hadyn/goscape/types"
     "errors"
@@ -19,43 +21,77 @@ var (
 const (
     ShortHeaderLength             = 5
     LongHeaderLength              = 9
+    LzmaPropertiesLength          = 5
+    lzmaSizeLength                = 8
+    VersionLength                 = 2
     None              Compression = 0
     Bzip2             Compression = 1
     Gzip              Compression = 2
+    Lzma              Compression = 3
 )
 
+// Container is an unpacked container along with its optional version trailer.
+type Container struct {
+    Compression Compression
+    Bytes       []byte
+    Version     uint16
+    Versioned   bool
+}
+
+// Unpack decompresses a container. Fails if the container is shorter than its header says.
 func Unpack(buffer []byte) ([]byte, error) {
+    end, err := PackedLength(buffer)
+    if err != nil {
+        return nil, err
+    }
+
     compression := Compression(buffer[0])
-    payloadLength := types.BigEndian.Uint32(buffer[1:])
 
     var length int
     switch compression {
     case None:
-        length = int(payloadLength)
-    case Bzip2, Gzip:
-        length = int(types.BigEndian.Uint32(buffer[ShortHeaderLength:]))
+        length = int(types.BigEndian.Uint32(buffer[1:]))
     default:
-        return nil, UnsupportedCompressionError
+        length = int(types.BigEndian.Uint32(buffer[ShortHeaderLength:]))
     }
 
-    headerLength, err := compression.headerLength()
+    reader, err := compression.reader(buffer[:end])
     if err != nil {
         return nil, err
     }
 
-    reader, err := compression.reader(buffer[:uint32(headerLength)+payloadLength])
+    if closer, ok := reader.(io.Closer); ok {
+        defer closer.Close()
+    }
+
+    return readFull(reader, length)
+}
+
+// DecompressBzip2 decompresses bzip2 data which has had its header stripped.
+func DecompressBzip2(buffer []byte, length int) ([]byte, error) {
+    reader, err := bzip2Reader(buffer)
     if err != nil {
         return nil, err
     }
+    defer reader.Close()
 
-    if closer, ok := reader.(io.Closer); ok {
-        defer closer.Close()
+    return readFull(reader, length)
+}
+
+// CompressBzip2 compresses data with bzip2 and strips the header.
+func CompressBzip2(buffer []byte) ([]byte, error) {
+    packed, err := Pack(buffer, Bzip2)
+    if err != nil {
+        return nil, err
     }
+    return packed[LongHeaderLength:], nil
+}
 
+func readFull(reader io.Reader, length int) ([]byte, error) {
     result := make([]byte, length)
 
     for offset := 0; offset < length; {
-        read, err := reader.Read(result[offset : length-offset])
+        read, err := reader.Read(result[offset:length])
         if err != nil {
             switch err {
             case io.EOF:
@@ -75,7 +111,7 @@ func Unpack(buffer []byte) ([]byte, error) {
 func Pack(buffer []byte, compression Compression) ([]byte, error) {
     var buf bytes.Buffer
 
-    writer, err := compression.writer(&buf)
+    writer, err := compression.writer(&buf, len(buffer))
     if err != nil {
         return nil, err
     }
@@ -94,26 +130,30 @@ func Pack(buffer []byte, compression Compression) ([]byte, error) {
         closer.Close()
     }
 
-    result := make([]byte, headerLength + buf.Len())
-
-    result[0] = byte(compression)
-    types.BigEndian.PutUint32(result[1:], uint32(buf.Len()))
+    compressed := buf.Bytes()
 
     switch compression {
-    case Bzip2, Gzip:
-        types.BigEndian.PutUint32(result[5:], uint32(len(buffer)))
+    case Bzip2:
+        // Strip the BZ2 header.
+        compressed = compressed[len(Bz2Header):]
+    case Lzma:
+        // Strip the uncompressed size which follows the properties.
+        compressed = append(compressed[:LzmaPropertiesLength:LzmaPropertiesLength],
+            compressed[LzmaPropertiesLength+lzmaSizeLength:]...)
     }
 
-    compressed := buf.Bytes()
+    result := make([]byte, headerLength + len(compressed))
+
+    result[0] = byte(compression)
+    types.BigEndian.PutUint32(result[1:], uint32(len(compressed)))
 
     switch compression {
-    case Bzip2:
-        // Strip the BZ2 header.
-        copy(result[headerLength:], compressed[len(Bz2Header):])
-    default:
-        copy(result[headerLength:], compressed)
+    case Bzip2, Gzip, Lzma:
+        types.BigEndian.PutUint32(result[5:], uint32(len(buffer)))
     }
 
+    copy(result[headerLength:], compressed)
+
     return result, nil
 }
 
@@ -122,17 +162,34 @@ func (c Compression) reader(buffer []byte) (io.Reader, error) {
     case None:
         return bytes.NewReader(buffer[ShortHeaderLength:]), nil
     case Bzip2:
-        return bzip2.NewReader(
-            bytes.NewReader(append(Bz2Header,
-                buffer[LongHeaderLength:]...)), &bzip2.ReaderConfig{})
+        return bzip2Reader(buffer[LongHeaderLength:])
     case Gzip:
         return gzip.NewReader(bytes.NewReader(buffer[LongHeaderLength:]))
+    case Lzma:
+        if len(buffer) < LongHeaderLength+LzmaPropertiesLength {
+            return nil, errors.New("lzma properties are missing")
+        }
+
+        // Rebuild the LZMA header by inserting the uncompressed size after the properties.
+        header := make([]byte, LzmaPropertiesLength+lzmaSizeLength)
+        copy(header, buffer[LongHeaderLength:LongHeaderLength+LzmaPropertiesLength])
+        binary.LittleEndian.PutUint64(header[LzmaPropertiesLength:],
+            uint64(types.BigEndian.Uint32(buffer[ShortHeaderLength:])))
+
+        return lzma.NewReader(io.MultiReader(bytes.NewReader(header),
+            bytes.NewReader(buffer[LongHeaderLength+LzmaPropertiesLength:])))
     default:
         return nil, UnsupportedCompressionError
     }
 }
 
-func (c Compression) writer(writer io.Writer) (io.Writer, error) {
+func bzip2Reader(buffer []byte) (*bzip2.Reader, error) {
+    header := make([]byte, len(Bz2Header), len(Bz2Header)+len(buffer))
+    copy(header, Bz2Header)
+    return bzip2.NewReader(bytes.NewReader(append(header, buffer...)), &bzip2.ReaderConfig{})
+}
+
+func (c Compression) writer(writer io.Writer, length int) (io.Writer, error) {
     switch c {
     case None:
         return writer, nil
@@ -140,6 +197,8 @@ func (c Compression) writer(writer io.Writer) (io.Writer, error) {
         return bzip2.NewWriter(writer, &bzip2.WriterConfig{Level:9})
     case Gzip:
         return gzip.NewWriter(writer), nil
+    case Lzma:
+        return lzma.WriterConfig{SizeInHeader: true, Size: int64(length)}.NewWriter(writer)
     default:
         return nil, UnsupportedCompressionError
     }
@@ -149,9 +208,121 @@ func (c Compression) headerLength() (int, error) {
     switch c {
     case None:
         return ShortHeaderLength, nil
-    case Bzip2, Gzip:
+    case Bzip2, Gzip, Lzma:
         return LongHeaderLength, nil
     default:
         return 0, UnsupportedCompressionError
     }
-}
\ No newline at end of file
+}
+
+// UnpackWithKey deciphers the payload of an encrypted container with the given key and
+// then unpacks it. The header is never encrypted.
+func UnpackWithKey(buffer []byte, key Key) ([]byte, error) {
+    if key.IsNull() {
+        return Unpack(buffer)
+    }
+
+    end, err := PackedLength(buffer)
+    if err != nil {
+        return nil, err
+    }
+
+    decrypted := make([]byte, len(buffer))
+    copy(decrypted, buffer)
+    key.Decipher(decrypted[ShortHeaderLength:end])
+
+    return Unpack(decrypted)
+}
+
+// PackWithKey packs the buffer and then enciphers the payload with the given key.
+func PackWithKey(buffer []byte, compression Compression, key Key) ([]byte, error) {
+    packed, err := Pack(buffer, compression)
+    if err != nil {
+        return nil, err
+    }
+
+    if key.IsNull() {
+        return packed, nil
+    }
+
+    end, err := PackedLength(packed)
+    if err != nil {
+        return nil, err
+    }
+
+    key.Encipher(packed[ShortHeaderLength:end])
+
+    return packed, nil
+}
+
+// Decode unpacks a container, deciphering it with the given key, and reads the version
+// trailer if one is present.
+func Decode(buffer []byte, key Key) (*Container, error) {
+    version, versioned, err := Version(buffer)
+    if err != nil {
+        return nil, err
+    }
+
+    unpacked, err := UnpackWithKey(buffer, key)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Container{
+        Compression: Compression(buffer[0]),
+        Bytes:       unpacked,
+        Version:     version,
+        Versioned:   versioned,
+    }, nil
+}
+
+// Encode packs the container, enciphering it with the given key, and appends the version
+// trailer if the container is versioned.
+func (c *Container) Encode(key Key) ([]byte, error) {
+    packed, err := PackWithKey(c.Bytes, c.Compression, key)
+    if err != nil {
+        return nil, err
+    }
+
+    if c.Versioned {
+        trailer := make([]byte, VersionLength)
+        types.BigEndian.PutUint16(trailer, c.Version)
+        packed = append(packed, trailer...)
+    }
+
+    return packed, nil
+}
+
+// Version reads the version trailer of a packed container. The trailer is optional and
+// the second return value reports whether it is present.
+func Version(buffer []byte) (uint16, bool, error) {
+    length, err := PackedLength(buffer)
+    if err != nil {
+        return 0, false, err
+    }
+
+    if len(buffer)-length < VersionLength {
+        return 0, false, nil
+    }
+
+    return types.BigEndian.Uint16(buffer[length:]), true, nil
+}
+
+// PackedLength returns the length of a packed container excluding the version trailer.
+func PackedLength(buffer []byte) (int, error) {
+    if len(buffer) < ShortHeaderLength {
+        return 0, errors.New("container is too short")
+    }
+
+    headerLength, err := Compression(buffer[0]).headerLength()
+    if err != nil {
+        return 0, err
+    }
+
+    end := headerLength + int(types.BigEndian.Uint32(buffer[1:]))
+    if end > len(buffer) {
+        return 0, errors.New("container is too short")
+    }
+
+    return end, nil
+}
@@ -5,6 +5,8 @@ import (
     "github.com/hadyn/goscape/types"
     "bytes"
     "encoding/base64"
+    "encoding/hex"
+    "github.com/hadyn/goscape/internal"
 )
 
 func TestUnpackContainerNoCompression(t *testing.T) {
@@ -122,4 +124,154 @@ func TestContainerRoundTripGzip(t *testing.T) {
     if !bytes.Equal(unpacked, contents) {
         t.Error("bytes mismatch")
     }
-}
\ No newline at end of file
+}
+
+func TestUnpackContainerWithKey(t *testing.T) {
+    key := Key{0x01234567, 0x89ABCDEF, 0xFEDCBA98, 0x76543210}
+    text := []byte("Hello world!")
+
+    contents, err := hex.DecodeString("77b43e079248511b")
+    if err != nil {
+        t.Fatal("failed to decode hex string")
+    }
+
+    // The trailing partial block is not encrypted.
+    contents = append(contents, text[XteaBlockLength:]...)
+
+    buffer := make([]byte, ShortHeaderLength+len(contents))
+
+    buffer[0] = byte(None)
+    types.BigEndian.PutUint32(buffer[1:], uint32(len(contents)))
+    copy(buffer[ShortHeaderLength:], contents)
+
+    unpacked, err := UnpackWithKey(buffer, key)
+    if err != nil {
+        t.Fatalf("failed to unpack the container: %s", err)
+    }
+
+    if !bytes.Equal(unpacked, text) {
+        t.Error("bytes mismatch")
+    }
+
+    packed, err := PackWithKey(text, None, key)
+    if err != nil {
+        t.Fatalf("failed to pack the bytes: %s", err)
+    }
+
+    if !bytes.Equal(packed, buffer) {
+        t.Error("packed bytes mismatch")
+    }
+}
+
+func TestContainerRoundTripWithKey(t *testing.T) {
+    key := Key{1, 2, 3, 4}
+    contents := []byte("Hello world!")
+
+    for _, compression := range []Compression{None, Bzip2, Gzip, Lzma} {
+        packed, err := PackWithKey(contents, compression, key)
+        if err != nil {
+            t.Fatalf("failed to pack the bytes: %s", err)
+        }
+
+        unpacked, err := UnpackWithKey(packed, key)
+        if err != nil {
+            t.Fatalf("failed to unpack the container: %s", err)
+        }
+
+        if !bytes.Equal(unpacked, contents) {
+            t.Errorf("bytes mismatch (compression: %d)", compression)
+        }
+    }
+}
+
+func TestUnpackContainerLzma(t *testing.T) {
+    text := []byte("Hello world!")
+
+    // The properties followed by the stream, without the uncompressed size.
+    contents, err := base64.StdEncoding.DecodeString(
+        "XQAAgAAAJBlJmG8QGcbXMes225LB0//+bAgA")
+    if err != nil {
+        t.Fatal("failed to decode base64 string")
+    }
+
+    buffer := make([]byte, LongHeaderLength+len(contents))
+
+    buffer[0] = byte(Lzma)
+    types.BigEndian.PutUint32(buffer[1:], uint32(len(contents)))
+    types.BigEndian.PutUint32(buffer[5:], uint32(len(text)))
+    copy(buffer[LongHeaderLength:], contents)
+
+    unpacked, err := Unpack(buffer)
+    if err != nil {
+        t.Fatalf("failed to unpack the container: %s", err)
+    }
+
+    if !bytes.Equal(unpacked, text) {
+        t.Error("bytes mismatch")
+    }
+}
+
+func TestContainerRoundTripLzma(t *testing.T) {
+    contents := internal.SequentialBytes(100000)
+
+    packed, err := Pack(contents, Lzma)
+    if err != nil {
+        t.Fatalf("failed to pack the bytes: %s", err)
+    }
+
+    unpacked, err := Unpack(packed)
+    if err != nil {
+        t.Fatalf("failed to unpack the container: %s", err)
+    }
+
+    if !bytes.Equal(unpacked, contents) {
+        t.Error("bytes mismatch")
+    }
+}
+
+func TestContainerVersion(t *testing.T) {
+    contents := []byte("Hello world!")
+
+    for _, compression := range []Compression{None, Gzip} {
+        c := &Container{Compression: compression, Bytes: contents, Version: 0x1234, Versioned: true}
+
+        packed, err := c.Encode(NullKey)
+        if err != nil {
+            t.Fatalf("failed to encode the container: %s", err)
+        }
+
+        if types.BigEndian.Uint16(packed[len(packed)-VersionLength:]) != 0x1234 {
+            t.Error("version trailer mismatch")
+        }
+
+        decoded, err := Decode(packed, NullKey)
+        if err != nil {
+            t.Fatalf("failed to decode the container: %s", err)
+        }
+
+        if !decoded.Versioned || decoded.Version != 0x1234 || decoded.Compression != compression {
+            t.Errorf("container mismatch (versioned: %t, version: %d)", decoded.Versioned, decoded.Version)
+        }
+
+        if !bytes.Equal(decoded.Bytes, contents) {
+            t.Error("bytes mismatch")
+        }
+
+        unversioned, err := Decode(packed[:len(packed)-VersionLength], NullKey)
+        if err != nil {
+            t.Fatalf("failed to decode the container: %s", err)
+        }
+
+        if unversioned.Versioned {
+            t.Error("unexpected version trailer")
+        }
+    }
+}
+
+func TestUnpackContainerTruncated(t *testing.T) {
+    for _, buffer := range [][]byte{{}, {byte(None), 0, 0}, {byte(None), 0x7F, 0, 0, 0, 1, 2, 3}, {byte(Gzip), 0, 0, 0, 0}} {
+        if _, err := Unpack(buffer); err == nil {
+            t.Errorf("expected an error unpacking a truncated container: %v", buffer)
+        }
+    }
+}
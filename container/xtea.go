@@ -0,0 +1,60 @@
+package container
+
+import (
+    "github.com/hadyn/goscape/types"
+)
+
+const (
+    XteaBlockLength = 8
+    xteaRounds      = 32
+    xteaDelta       = 0x9E3779B9
+    xteaSum         = 0xC6EF3720 // The delta multiplied by the number of rounds, truncated.
+)
+
+// Key is a 128-bit XTEA key. The zero key denotes that the payload is not encrypted.
+type Key [4]uint32
+
+var NullKey Key
+
+// IsNull returns whether the key is the zero key.
+func (k Key) IsNull() bool {
+    return k == NullKey
+}
+
+// Encipher encrypts every complete 8-byte block of the buffer in place. Any trailing
+// partial block is left untouched.
+func (k Key) Encipher(buffer []byte) {
+    for i := 0; i+XteaBlockLength <= len(buffer); i += XteaBlockLength {
+        v0 := types.BigEndian.Uint32(buffer[i:])
+        v1 := types.BigEndian.Uint32(buffer[i+4:])
+
+        sum := uint32(0)
+        for round := 0; round < xteaRounds; round++ {
+            v0 += (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + k[sum&3])
+            sum += xteaDelta
+            v1 += (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + k[(sum>>11)&3])
+        }
+
+        types.BigEndian.PutUint32(buffer[i:], v0)
+        types.BigEndian.PutUint32(buffer[i+4:], v1)
+    }
+}
+
+// Decipher decrypts every complete 8-byte block of the buffer in place. Any trailing
+// partial block is left untouched.
+func (k Key) Decipher(buffer []byte) {
+    for i := 0; i+XteaBlockLength <= len(buffer); i += XteaBlockLength {
+        v0 := types.BigEndian.Uint32(buffer[i:])
+        v1 := types.BigEndian.Uint32(buffer[i+4:])
+
+        sum := uint32(xteaSum)
+        for round := 0; round < xteaRounds; round++ {
+            v1 -= (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + k[(sum>>11)&3])
+            sum -= xteaDelta
+            v0 -= (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + k[sum&3])
+        }
+
+        types.BigEndian.PutUint32(buffer[i:], v0)
+        types.BigEndian.PutUint32(buffer[i+4:], v1)
+    }
+}
@@ -0,0 +1,168 @@
+package jag
+
+import (
+    "errors"
+    "fmt"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/names"
+    "github.com/hadyn/goscape/types"
+)
+
+const (
+    HeaderLength      = 6
+    EntryHeaderLength = 10
+)
+
+var (
+    TruncatedArchiveError = errors.New("truncated archive")
+)
+
+// Archive is a legacy JAG archive. The archive starts with its uncompressed and compressed
+// lengths, and if they differ the remainder of the archive is bzip2 compressed as a whole.
+// Otherwise every entry is compressed individually, as the client decompresses each entry
+// of an archive which is not compressed as a whole regardless of its lengths.
+type Archive struct {
+    Entries []*Entry
+}
+
+type Entry struct {
+    NameHash uint32
+    Bytes    []byte
+}
+
+// Decode decodes an archive, decompressing the archive or its entries.
+func Decode(buffer []byte) (*Archive, error) {
+    if len(buffer) < HeaderLength {
+        return nil, TruncatedArchiveError
+    }
+
+    length := int(types.BigEndian.Uint24(buffer[0:]))
+    compressedLength := int(types.BigEndian.Uint24(buffer[3:]))
+    if len(buffer) < HeaderLength+compressedLength {
+        return nil, TruncatedArchiveError
+    }
+
+    data := buffer[HeaderLength : HeaderLength+compressedLength]
+    whole := length != compressedLength
+    if whole {
+        var err error
+        if data, err = container.DecompressBzip2(data, length); err != nil {
+            return nil, err
+        }
+    }
+
+    if len(data) < 2 {
+        return nil, TruncatedArchiveError
+    }
+
+    count := int(types.BigEndian.Uint16(data[0:]))
+    position := 2 + count*EntryHeaderLength
+    if len(data) < position {
+        return nil, TruncatedArchiveError
+    }
+
+    archive := &Archive{Entries: make([]*Entry, count)}
+    for i := range archive.Entries {
+        header := data[2+i*EntryHeaderLength:]
+        hash := types.BigEndian.Uint32(header[0:])
+        length := int(types.BigEndian.Uint24(header[4:]))
+        compressedLength := int(types.BigEndian.Uint24(header[7:]))
+
+        if len(data) < position+compressedLength {
+            return nil, TruncatedArchiveError
+        }
+
+        bytes := data[position : position+compressedLength]
+        if !whole {
+            var err error
+            if bytes, err = container.DecompressBzip2(bytes, length); err != nil {
+                return nil, err
+            }
+        } else if length != compressedLength {
+            return nil, errors.New(fmt.Sprintf("entry %d is compressed within a compressed archive", i))
+        }
+
+        archive.Entries[i] = &Entry{NameHash: hash, Bytes: bytes}
+        position += compressedLength
+    }
+
+    return archive, nil
+}
+
+// Encode encodes the archive. If whole is set the archive is compressed as a whole,
+// otherwise each entry is compressed individually.
+func (a *Archive) Encode(whole bool) ([]byte, error) {
+    if len(a.Entries) > 0xFFFF {
+        return nil, errors.New(fmt.Sprintf("too many entries: %d", len(a.Entries)))
+    }
+
+    entries := make([][]byte, len(a.Entries))
+    length := 2 + len(a.Entries)*EntryHeaderLength
+    for i, entry := range a.Entries {
+        entries[i] = entry.Bytes
+        if !whole {
+            compressed, err := container.CompressBzip2(entry.Bytes)
+            if err != nil {
+                return nil, err
+            }
+            entries[i] = compressed
+        }
+        length += len(entries[i])
+    }
+
+    data := make([]byte, length)
+    types.BigEndian.PutUint16(data[0:], uint16(len(a.Entries)))
+
+    position := 2 + len(a.Entries)*EntryHeaderLength
+    for i, entry := range a.Entries {
+        if len(entry.Bytes) > 0xFFFFFF || len(entries[i]) > 0xFFFFFF {
+            return nil, errors.New(fmt.Sprintf("entry %d is too large", i))
+        }
+
+        header := data[2+i*EntryHeaderLength:]
+        types.BigEndian.PutUint32(header[0:], entry.NameHash)
+        types.BigEndian.PutUint24(header[4:], uint32(len(entry.Bytes)))
+        types.BigEndian.PutUint24(header[7:], uint32(len(entries[i])))
+
+        copy(data[position:], entries[i])
+        position += len(entries[i])
+    }
+
+    compressed := data
+    if whole {
+        var err error
+        if compressed, err = container.CompressBzip2(data); err != nil {
+            return nil, err
+        }
+
+        if len(compressed) == len(data) {
+            return nil, errors.New("compressed archive length is indistinguishable from its length")
+        }
+    }
+
+    if len(data) > 0xFFFFFF || len(compressed) > 0xFFFFFF {
+        return nil, errors.New("archive is too large")
+    }
+
+    result := make([]byte, HeaderLength+len(compressed))
+    types.BigEndian.PutUint24(result[0:], uint32(len(data)))
+    types.BigEndian.PutUint24(result[3:], uint32(len(compressed)))
+    copy(result[HeaderLength:], compressed)
+
+    return result, nil
+}
+
+// Entry returns the entry with the given name hash or nil if it does not exist.
+func (a *Archive) Entry(hash uint32) *Entry {
+    for _, entry := range a.Entries {
+        if entry.NameHash == hash {
+            return entry
+        }
+    }
+    return nil
+}
+
+// EntryByName returns the entry with the given name or nil if it does not exist.
+func (a *Archive) EntryByName(name string) *Entry {
+    return a.Entry(names.JagHash(name))
+}
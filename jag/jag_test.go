@@ -0,0 +1,98 @@
+package jag
+
+import (
+    "testing"
+    "bytes"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/internal"
+    "github.com/hadyn/goscape/names"
+)
+
+func TestDecodeEntriesCompressed(t *testing.T) {
+    hello, err := container.CompressBzip2([]byte("hello"))
+    if err != nil {
+        t.Fatal("failed to compress the entry", err)
+    }
+
+    // Empty entries are compressed as well.
+    empty, err := container.CompressBzip2(nil)
+    if err != nil {
+        t.Fatal("failed to compress the entry", err)
+    }
+
+    data := []byte{
+        0, 2, // Entry count
+        0, 0, 0, 1, 0, 0, 5, 0, 0, byte(len(hello)), // Entry headers
+        0, 0, 0, 2, 0, 0, 0, 0, 0, byte(len(empty)),
+    }
+    data = append(append(data, hello...), empty...)
+
+    buffer := []byte{0, 0, byte(len(data)), 0, 0, byte(len(data))} // Archive lengths
+    buffer = append(buffer, data...)
+
+    archive, err := Decode(buffer)
+    if err != nil {
+        t.Fatalf("failed to decode the archive: %s", err)
+    }
+
+    if len(archive.Entries) != 2 {
+        t.Fatalf("entry count mismatch (expected: %d, actual: %d)", 2, len(archive.Entries))
+    }
+
+    if entry := archive.Entry(1); entry == nil || !bytes.Equal(entry.Bytes, []byte("hello")) {
+        t.Error("bytes mismatch")
+    }
+
+    if entry := archive.Entry(2); entry == nil || len(entry.Bytes) != 0 {
+        t.Error("expected an empty entry")
+    }
+
+    // A raw entry is not valid within an archive which is not compressed as a whole.
+    raw := []byte{0, 0, 17, 0, 0, 17, 0, 1, 0, 0, 0, 1, 0, 0, 5, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+    if _, err := Decode(raw); err == nil {
+        t.Error("expected an error decoding an uncompressed entry")
+    }
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+    archive := &Archive{Entries: []*Entry{
+        {NameHash: 1, Bytes: []byte("Hello world!")},
+        {NameHash: 2, Bytes: internal.SequentialBytes(5000)},
+    }}
+
+    for _, whole := range []bool{true, false} {
+        encoded, err := archive.Encode(whole)
+        if err != nil {
+            t.Fatalf("failed to encode the archive: %s", err)
+        }
+
+        decoded, err := Decode(encoded)
+        if err != nil {
+            t.Fatalf("failed to decode the archive: %s", err)
+        }
+
+        for _, entry := range archive.Entries {
+            if other := decoded.Entry(entry.NameHash); other == nil || !bytes.Equal(other.Bytes, entry.Bytes) {
+                t.Errorf("entry %d mismatch (whole: %t)", entry.NameHash, whole)
+            }
+        }
+    }
+}
+
+func TestDecodeTruncated(t *testing.T) {
+    if _, err := Decode([]byte{0, 0, 10, 0, 0, 10, 0}); err != TruncatedArchiveError {
+        t.Errorf("expected truncated archive error, got: %v", err)
+    }
+}
+
+func TestArchiveEntryByName(t *testing.T) {
+    archive := &Archive{Entries: []*Entry{{NameHash: names.JagHash("index.dat"), Bytes: []byte{1}}}}
+
+    if entry := archive.EntryByName("INDEX.DAT"); entry == nil || entry.Bytes[0] != 1 {
+        t.Error("entry mismatch")
+    }
+
+    if archive.EntryByName("data") != nil {
+        t.Error("expected no entry")
+    }
+}
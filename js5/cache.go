@@ -0,0 +1,120 @@
+package js5
+
+import (
+    "container/list"
+    "sync"
+    "github.com/hadyn/goscape/storage"
+)
+
+type cacheKey struct {
+    index uint8
+    group uint16
+}
+
+type cacheEntry struct {
+    key      cacheKey
+    response []byte
+}
+
+// cache holds the most recently used responses, framed as urgent responses without any
+// encryption. Responses are evicted once the cache is larger than its capacity, or once
+// their group is written to.
+type cache struct {
+    mutex    sync.Mutex
+    capacity int
+    size     int
+    entries  map[cacheKey]*list.Element
+    order    *list.List
+    watched  map[*storage.Volume]*sync.Once
+    writes   map[cacheKey]uint64
+    hits     int
+    misses   int
+}
+
+func newCache(capacity int) *cache {
+    return &cache{
+        capacity: capacity,
+        entries:  make(map[cacheKey]*list.Element),
+        order:    list.New(),
+        watched:  make(map[*storage.Volume]*sync.Once),
+        writes:   make(map[cacheKey]uint64),
+    }
+}
+
+// get returns the cached response to a request, loading and caching it if it is not
+// cached. The returned response must not be modified.
+func (c *cache) get(index uint8, volume *storage.Volume, group uint16, load func() ([]byte, error)) ([]byte, error) {
+    key := cacheKey{index, group}
+
+    c.mutex.Lock()
+    once, ok := c.watched[volume]
+    if !ok {
+        once = &sync.Once{}
+        c.watched[volume] = once
+    }
+    c.mutex.Unlock()
+
+    // The watcher is registered without holding the mutex, as the volume holds its own lock
+    // while calling the watcher. Every other request for the volume waits until it has been
+    // registered, so nothing is cached which a write could fail to invalidate.
+    once.Do(func() {
+        volume.Watch(func(id uint32) {
+            if id <= 0xFFFF {
+                c.invalidate(cacheKey{index, uint16(id)})
+            }
+        })
+    })
+
+    c.mutex.Lock()
+    if element, ok := c.entries[key]; ok {
+        c.order.MoveToFront(element)
+        c.hits++
+        response := element.Value.(*cacheEntry).response
+        c.mutex.Unlock()
+        return response, nil
+    }
+
+    c.misses++
+    writes := c.writes[key]
+    c.mutex.Unlock()
+
+    response, err := load()
+    if err != nil {
+        return nil, err
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    // Another request may have loaded the group in the meantime, and if the group was
+    // written to the loaded response may already be stale.
+    if _, ok := c.entries[key]; ok || c.writes[key] != writes || len(response) > c.capacity {
+        return response, nil
+    }
+
+    c.entries[key] = c.order.PushFront(&cacheEntry{key, response})
+    c.size += len(response)
+    for c.size > c.capacity {
+        c.remove(c.order.Back())
+    }
+
+    return response, nil
+}
+
+// invalidate evicts the response to a group and counts the write, so that responses loaded
+// before the write are not cached.
+func (c *cache) invalidate(key cacheKey) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    c.writes[key]++
+    if element, ok := c.entries[key]; ok {
+        c.remove(element)
+    }
+}
+
+func (c *cache) remove(element *list.Element) {
+    entry := c.order.Remove(element).(*cacheEntry)
+    delete(c.entries, entry.key)
+    c.size -= len(entry.response)
+}
@@ -0,0 +1,130 @@
+package js5
+
+import (
+    "testing"
+    "bytes"
+    "sync"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/storage"
+)
+
+func TestCacheEviction(t *testing.T) {
+    volume := storage.NewVolume(0, storage.NewMemoryStore(nil), storage.NewMemoryStore(nil), &sync.RWMutex{})
+    cache := newCache(10)
+
+    loads := 0
+    load := func() ([]byte, error) {
+        loads++
+        return make([]byte, 4), nil
+    }
+
+    for _, group := range []uint16{0, 1, 0, 2, 1} {
+        if _, err := cache.get(0, volume, group, load); err != nil {
+            t.Fatal("failed to get the response", err)
+        }
+    }
+
+    // Group 1 is evicted when group 2 is loaded, as group 0 was used more recently.
+    if loads != 4 || cache.hits != 1 {
+        t.Errorf("load mismatch (loads: %d, hits: %d)", loads, cache.hits)
+    }
+
+    if cache.size != 8 || len(cache.entries) != 2 {
+        t.Errorf("size mismatch (size: %d, entries: %d)", cache.size, len(cache.entries))
+    }
+}
+
+func TestCacheWrittenWhileLoading(t *testing.T) {
+    volume := storage.NewVolume(0, storage.NewMemoryStore(nil), storage.NewMemoryStore(nil), &sync.RWMutex{})
+    cache := newCache(100)
+
+    // A write to another group does not stop the response from being cached.
+    if _, err := cache.get(0, volume, 0, func() ([]byte, error) {
+        return make([]byte, 4), volume.Write(1, []byte{1})
+    }); err != nil {
+        t.Fatal("failed to get the response", err)
+    }
+
+    if len(cache.entries) != 1 {
+        t.Errorf("expected the response to be cached (entries: %d)", len(cache.entries))
+    }
+
+    // A write to the group itself does.
+    if _, err := cache.get(0, volume, 1, func() ([]byte, error) {
+        return make([]byte, 4), volume.Write(1, []byte{2})
+    }); err != nil {
+        t.Fatal("failed to get the response", err)
+    }
+
+    if len(cache.entries) != 1 {
+        t.Errorf("expected the stale response not to be cached (entries: %d)", len(cache.entries))
+    }
+
+    // A reopened volume is watched as well.
+    reopened := storage.NewVolume(0, storage.NewMemoryStore(nil), storage.NewMemoryStore(nil), &sync.RWMutex{})
+    if _, err := cache.get(0, reopened, 2, func() ([]byte, error) {
+        return make([]byte, 4), nil
+    }); err != nil {
+        t.Fatal("failed to get the response", err)
+    }
+
+    if err := reopened.Write(0, []byte{3}); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    if _, ok := cache.entries[cacheKey{0, 0}]; ok {
+        t.Error("expected the written group to be evicted")
+    }
+}
+
+func TestServerCacheInvalidated(t *testing.T) {
+    server, expected, cleanup := newTestServer(t, Config{})
+    defer cleanup()
+
+    client, _, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    defer client.Close()
+
+    receive := func() []byte {
+        if err := client.Request(Request{Index: 2, Group: 1, Urgent: true}); err != nil {
+            t.Fatal("failed to send the request", err)
+        }
+
+        response, err := client.Receive()
+        if err != nil {
+            t.Fatal("failed to receive the response", err)
+        }
+        return response.Container
+    }
+
+    for i := 0; i < 2; i++ {
+        if !bytes.Equal(receive(), expected) {
+            t.Error("container mismatch")
+        }
+    }
+
+    if metrics := server.Metrics(); metrics.CacheHits != 1 || metrics.CacheMisses != 1 {
+        t.Errorf("cache metrics mismatch: %+v", metrics)
+    }
+
+    packed, err := container.Pack([]byte("changed"), container.None)
+    if err != nil {
+        t.Fatal("failed to pack the entry", err)
+    }
+
+    volume, err := server.storage.Open(2)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if err := volume.Write(1, packed); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    if !bytes.Equal(receive(), packed) {
+        t.Error("expected the written entry to be served")
+    }
+}
@@ -0,0 +1,163 @@
+package js5
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/types"
+)
+
+// Client is a minimal JS5 client, used to test servers in process.
+type Client struct {
+    conn   net.Conn
+    key    byte
+    offset int
+}
+
+// Response is a response to a request, holding the container of the group without its
+// version trailer.
+type Response struct {
+    Request
+    Container []byte
+}
+
+// Dial performs the handshake with a server over the connection.
+func Dial(conn net.Conn, revision uint32) (*Client, error) {
+    buffer := make([]byte, HandshakeLength)
+    buffer[0] = HandshakeOpcode
+    types.BigEndian.PutUint32(buffer[1:], revision)
+
+    if _, err := conn.Write(buffer); err != nil {
+        return nil, err
+    }
+
+    status := make([]byte, 1)
+    if _, err := io.ReadFull(conn, status); err != nil {
+        return nil, err
+    }
+
+    switch status[0] {
+    case StatusOk:
+        return &Client{conn: conn}, nil
+    case StatusOutOfDate:
+        return nil, OutOfDateError
+    default:
+        return nil, errors.New(fmt.Sprintf("unexpected handshake status: %d", status[0]))
+    }
+}
+
+// Request requests a group.
+func (c *Client) Request(request Request) error {
+    opcode := byte(OpcodePrefetch)
+    if request.Urgent {
+        opcode = OpcodeUrgent
+    }
+
+    buffer := make([]byte, RequestLength)
+    buffer[0] = opcode
+    buffer[1] = request.Index
+    types.BigEndian.PutUint16(buffer[2:], request.Group)
+    return c.send(buffer)
+}
+
+// SetLoggedIn tells the server whether the player is logged in.
+func (c *Client) SetLoggedIn(loggedIn bool) error {
+    opcode := byte(OpcodeLoggedOut)
+    if loggedIn {
+        opcode = OpcodeLoggedIn
+    }
+    return c.send([]byte{opcode, 0, 0, 0})
+}
+
+// SetKey tells the server to encrypt every following response with the key.
+func (c *Client) SetKey(key byte) error {
+    if err := c.send([]byte{OpcodeEncryptionKey, key, 0, 0}); err != nil {
+        return err
+    }
+
+    c.key = key
+    return nil
+}
+
+// Receive reads the next response.
+func (c *Client) Receive() (*Response, error) {
+    c.offset = 0
+    header, err := c.read(ResponseHeaderLength + container.ShortHeaderLength)
+    if err != nil {
+        return nil, err
+    }
+
+    compression := header[ResponseHeaderLength]
+    length := int(types.BigEndian.Uint32(header[ResponseHeaderLength+1:]))
+    if container.Compression(compression&^PrefetchFlag) != container.None {
+        length += container.LongHeaderLength - container.ShortHeaderLength
+    }
+
+    remaining, err := c.read(length)
+    if err != nil {
+        return nil, err
+    }
+
+    buffer := append(header[ResponseHeaderLength:], remaining...)
+    buffer[0] &^= PrefetchFlag
+
+    return &Response{
+        Request: Request{
+            Index:  header[0],
+            Group:  types.BigEndian.Uint16(header[1:]),
+            Urgent: compression&PrefetchFlag == 0,
+        },
+        Container: buffer,
+    }, nil
+}
+
+// Close tells the server the client is disconnecting and closes the connection.
+func (c *Client) Close() error {
+    c.send([]byte{OpcodeDisconnect, 0, 0, 0})
+    return c.conn.Close()
+}
+
+func (c *Client) send(buffer []byte) error {
+    _, err := c.conn.Write(buffer)
+    return err
+}
+
+// read reads bytes of the current response, skipping the marker at the start of each chunk
+// and decrypting them if a key is set.
+func (c *Client) read(length int) ([]byte, error) {
+    buffer := make([]byte, 0, length)
+    marker := make([]byte, 1)
+    for len(buffer) < length {
+        if c.offset > 0 && c.offset%ChunkLength == 0 {
+            if _, err := io.ReadFull(c.conn, marker); err != nil {
+                return nil, err
+            }
+
+            if marker[0]^c.key != ChunkMarker {
+                return nil, errors.New(fmt.Sprintf("unexpected chunk marker: %d", marker[0]^c.key))
+            }
+            c.offset++
+        }
+
+        n := ChunkLength - c.offset%ChunkLength
+        if remaining := length - len(buffer); remaining < n {
+            n = remaining
+        }
+
+        chunk := buffer[len(buffer) : len(buffer)+n]
+        if _, err := io.ReadFull(c.conn, chunk); err != nil {
+            return nil, err
+        }
+
+        for i := range chunk {
+            chunk[i] ^= c.key
+        }
+
+        buffer = buffer[:len(buffer)+n]
+        c.offset += n
+    }
+
+    return buffer, nil
+}
@@ -0,0 +1,81 @@
+package js5
+
+import (
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/types"
+)
+
+const (
+    HandshakeOpcode      = 15
+    HandshakeLength      = 5
+    RequestLength        = 4
+    ResponseHeaderLength = 3
+    ChunkLength          = 512
+    ChunkMarker          = 0xFF
+    PrefetchFlag         = 0x80
+)
+
+const (
+    StatusOk        = 0
+    StatusOutOfDate = 6
+)
+
+const (
+    OpcodePrefetch      = 0
+    OpcodeUrgent        = 1
+    OpcodeLoggedIn      = 2
+    OpcodeLoggedOut     = 3
+    OpcodeEncryptionKey = 4
+    OpcodeInitialised   = 6
+    OpcodeDisconnect    = 7
+)
+
+// Request is a request for a group. Requests for the reference table volume are for the
+// reference table of the volume with the same identifier as the group.
+type Request struct {
+    Index  uint8
+    Group  uint16
+    Urgent bool
+}
+
+// frame frames an entry as read from a volume into a response. The version trailer of the
+// entry is dropped, prefetched responses have their compression flagged and a marker is
+// inserted at the start of every chunk after the first.
+func frame(request Request, entry []byte) ([]byte, error) {
+    length, err := container.PackedLength(entry)
+    if err != nil {
+        return nil, err
+    }
+
+    payload := make([]byte, ResponseHeaderLength+length)
+    payload[0] = request.Index
+    types.BigEndian.PutUint16(payload[1:], request.Group)
+    copy(payload[ResponseHeaderLength:], entry[:length])
+
+    if !request.Urgent {
+        payload[ResponseHeaderLength] |= PrefetchFlag
+    }
+
+    markers := 0
+    if len(payload) > ChunkLength {
+        markers = (len(payload) - ChunkLength + ChunkLength - 2) / (ChunkLength - 1)
+    }
+
+    buffer := make([]byte, 0, len(payload)+markers)
+    for offset := 0; offset < len(payload); {
+        n := ChunkLength
+        if offset > 0 {
+            buffer = append(buffer, ChunkMarker)
+            n--
+        }
+
+        if remaining := len(payload) - offset; remaining < n {
+            n = remaining
+        }
+
+        buffer = append(buffer, payload[offset:offset+n]...)
+        offset += n
+    }
+
+    return buffer, nil
+}
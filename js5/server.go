@@ -0,0 +1,493 @@
+package js5
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "github.com/hadyn/goscape/storage"
+    "github.com/hadyn/goscape/types"
+)
+
+const (
+    DefaultWorkers     = 4
+    DefaultMaxInFlight = 64 * 1024
+    DefaultMaxQueued   = 256
+    DefaultCacheSize   = 32 * 1024 * 1024
+)
+
+var (
+    OutOfDateError    = errors.New("client is out of date")
+    ServerClosedError = errors.New("server is closed")
+    QueueFullError    = errors.New("too many requests are queued")
+)
+
+// Config configures a server. Zero values are replaced with their defaults.
+type Config struct {
+    Revision uint32
+
+    // Workers is the number of goroutines reading groups from the storage.
+    Workers int
+
+    // MaxInFlight is the number of bytes which may be waiting to be written to a connection
+    // before no more of its requests are served.
+    MaxInFlight int
+
+    // MaxQueued is the number of urgent or prefetch requests which may be queued for a
+    // connection. A connection which sends more is closed.
+    MaxQueued int
+
+    // CacheSize is the number of bytes of responses which are cached.
+    CacheSize int
+}
+
+// Server serves groups from a storage to clients over the JS5 protocol. Reference tables
+// and the checksum table are served from the reference table volume, so the checksum table
+// should be rebuilt whenever a reference table changes.
+//
+// Requests are queued per connection and served by a fixed number of workers. Urgent
+// requests are always served before prefetch requests, and the workers take turns between
+// connections so that one client requesting many groups cannot starve the others. The
+// most recently requested groups are cached until they are written to.
+//
+// The client has no way to be told that a group does not exist, so a request for a missing
+// index or group closes the connection with EntryNotFoundError.
+type Server struct {
+    storage     *storage.Storage
+    revision    uint32
+    maxInFlight int
+    maxQueued   int
+    cache       *cache
+    mutex       sync.Mutex
+    work        *sync.Cond
+    connections []*connection
+    next        int
+    closed      bool
+}
+
+// Metrics describes the queues of a server at a point in time.
+type Metrics struct {
+    Connections    int
+    UrgentQueued   int
+    PrefetchQueued int
+    InFlight       int
+    CacheHits      int
+    CacheMisses    int
+}
+
+// connection holds the state of a single client. Everything but the underlying connection
+// is guarded by the mutex of the server.
+type connection struct {
+    conn     net.Conn
+    key      byte
+    loggedIn bool
+    urgent   []Request
+    prefetch []Request
+    outbound [][]byte
+    inFlight int
+    pending  int
+    writable *sync.Cond
+    err      error
+    closed   bool
+}
+
+func NewServer(storage *storage.Storage, config Config) *Server {
+    if config.Workers <= 0 {
+        config.Workers = DefaultWorkers
+    }
+
+    if config.MaxInFlight <= 0 {
+        config.MaxInFlight = DefaultMaxInFlight
+    }
+
+    if config.MaxQueued <= 0 {
+        config.MaxQueued = DefaultMaxQueued
+    }
+
+    if config.CacheSize <= 0 {
+        config.CacheSize = DefaultCacheSize
+    }
+
+    s := &Server{
+        storage:     storage,
+        revision:    config.Revision,
+        maxInFlight: config.MaxInFlight,
+        maxQueued:   config.MaxQueued,
+        cache:       newCache(config.CacheSize),
+    }
+    s.work = sync.NewCond(&s.mutex)
+
+    for i := 0; i < config.Workers; i++ {
+        go s.serve()
+    }
+
+    return s
+}
+
+// Serve accepts connections from the listener and serves each of them on its own
+// goroutine. Returns once the listener fails to accept a connection.
+func (s *Server) Serve(listener net.Listener) error {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            return err
+        }
+
+        go s.ServeConn(conn)
+    }
+}
+
+// ServeConn performs the handshake with a client and serves its requests until the client
+// disconnects. The connection is closed once it returns.
+func (s *Server) ServeConn(conn net.Conn) error {
+    defer conn.Close()
+
+    if err := s.handshake(conn); err != nil {
+        return err
+    }
+
+    c := &connection{conn: conn, writable: sync.NewCond(&s.mutex)}
+
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        return ServerClosedError
+    }
+    s.connections = append(s.connections, c)
+    s.mutex.Unlock()
+
+    written := make(chan struct{})
+    go func() {
+        s.write(c)
+        close(written)
+    }()
+
+    err := s.read(c)
+
+    // Prefer the error which caused the connection to be closed, as reading fails with a
+    // less useful error once it is.
+    s.mutex.Lock()
+    if c.err != nil {
+        err = c.err
+    }
+    s.close(c)
+    s.mutex.Unlock()
+
+    // Unblock the writer if it is still writing a response.
+    conn.Close()
+    <-written
+    return err
+}
+
+// Metrics returns the current queue depths of the server.
+func (s *Server) Metrics() Metrics {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    metrics := Metrics{Connections: len(s.connections)}
+    for _, c := range s.connections {
+        metrics.UrgentQueued += len(c.urgent)
+        metrics.PrefetchQueued += len(c.prefetch)
+        metrics.InFlight += c.inFlight
+    }
+
+    s.cache.mutex.Lock()
+    metrics.CacheHits = s.cache.hits
+    metrics.CacheMisses = s.cache.misses
+    s.cache.mutex.Unlock()
+
+    return metrics
+}
+
+// Close stops the workers and closes every connection.
+func (s *Server) Close() error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.closed = true
+    for len(s.connections) > 0 {
+        s.fail(s.connections[0], ServerClosedError)
+    }
+    s.work.Broadcast()
+    return nil
+}
+
+// handshake reads the revision of the client and replies with whether it is up to date.
+func (s *Server) handshake(conn net.Conn) error {
+    buffer := make([]byte, HandshakeLength)
+    if _, err := io.ReadFull(conn, buffer); err != nil {
+        return err
+    }
+
+    if buffer[0] != HandshakeOpcode {
+        return errors.New(fmt.Sprintf("unexpected handshake opcode: %d", buffer[0]))
+    }
+
+    if types.BigEndian.Uint32(buffer[1:]) != s.revision {
+        conn.Write([]byte{StatusOutOfDate})
+        return OutOfDateError
+    }
+
+    _, err := conn.Write([]byte{StatusOk})
+    return err
+}
+
+// read reads messages from a client until it disconnects, queueing its requests.
+func (s *Server) read(c *connection) error {
+    buffer := make([]byte, RequestLength)
+    for {
+        if _, err := io.ReadFull(c.conn, buffer); err != nil {
+            if err == io.EOF {
+                return nil
+            }
+            return err
+        }
+
+        opcode := buffer[0]
+        if opcode == OpcodeDisconnect {
+            return nil
+        }
+
+        s.mutex.Lock()
+        switch opcode {
+        case OpcodePrefetch, OpcodeUrgent:
+            request := Request{
+                Index:  buffer[1],
+                Group:  types.BigEndian.Uint16(buffer[2:]),
+                Urgent: opcode == OpcodeUrgent,
+            }
+
+            queue := &c.prefetch
+            if request.Urgent {
+                queue = &c.urgent
+            }
+
+            if len(*queue) >= s.maxQueued {
+                s.mutex.Unlock()
+                return QueueFullError
+            }
+
+            *queue = append(*queue, request)
+            s.work.Signal()
+        case OpcodeLoggedIn, OpcodeLoggedOut:
+            c.loggedIn = opcode == OpcodeLoggedIn
+        case OpcodeEncryptionKey:
+            c.key = buffer[1]
+        case OpcodeInitialised:
+        default:
+            s.mutex.Unlock()
+            return errors.New(fmt.Sprintf("unknown opcode: %d", opcode))
+        }
+        s.mutex.Unlock()
+    }
+}
+
+// write writes the responses of a connection as they are framed, until it is closed. Each
+// response is encrypted with the key of the connection at the time it is written.
+func (s *Server) write(c *connection) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    for {
+        for len(c.outbound) == 0 && !c.closed {
+            c.writable.Wait()
+        }
+
+        if c.closed {
+            return
+        }
+
+        response := c.outbound[0]
+        c.outbound = c.outbound[1:]
+        key := c.key
+
+        s.mutex.Unlock()
+        _, err := c.conn.Write(encrypt(response, key))
+        s.mutex.Lock()
+
+        if c.closed {
+            return
+        }
+
+        c.inFlight -= len(response)
+        if err != nil {
+            s.fail(c, err)
+            return
+        }
+
+        // The connection may have room for more responses.
+        s.work.Broadcast()
+    }
+}
+
+// serve is run by each worker, serving requests until the server is closed.
+func (s *Server) serve() {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    for {
+        c, request, ok := s.schedule()
+        for !ok && !s.closed {
+            s.work.Wait()
+            c, request, ok = s.schedule()
+        }
+
+        if s.closed {
+            return
+        }
+
+        s.mutex.Unlock()
+        response, err := s.respond(request)
+        s.mutex.Lock()
+
+        c.pending--
+        if c.closed {
+            continue
+        }
+
+        if err != nil {
+            s.fail(c, err)
+            continue
+        }
+
+        c.outbound = append(c.outbound, response)
+        c.inFlight += len(response)
+        c.writable.Signal()
+    }
+}
+
+// schedule takes the next request to serve. Urgent requests are taken before prefetch
+// requests, and connections are taken in turn, skipping those with too many bytes in
+// flight. Only one response is framed for a connection at a time, so that the workers
+// cannot take it past its limit before their responses are counted as in flight. Must be
+// called with the mutex held.
+func (s *Server) schedule() (*connection, Request, bool) {
+    for _, urgent := range []bool{true, false} {
+        for i := 0; i < len(s.connections); i++ {
+            index := (s.next + i) % len(s.connections)
+            c := s.connections[index]
+            if c.pending > 0 || c.inFlight >= s.maxInFlight {
+                continue
+            }
+
+            queue := &c.prefetch
+            if urgent {
+                queue = &c.urgent
+            }
+
+            if len(*queue) == 0 {
+                continue
+            }
+
+            request := (*queue)[0]
+            *queue = (*queue)[1:]
+            c.pending++
+            s.next = (index + 1) % len(s.connections)
+            return c, request, true
+        }
+    }
+
+    return nil, Request{}, false
+}
+
+// respond frames the response to a request.
+func (s *Server) respond(request Request) ([]byte, error) {
+    // Opening a volume in read-write mode creates its index file, so clients must not be
+    // able to open volumes which do not exist.
+    if exists, err := s.storage.Exists(request.Index); !exists || err != nil {
+        if err != nil {
+            return nil, err
+        }
+        return nil, storage.EntryNotFoundError
+    }
+
+    volume, err := s.storage.Open(request.Index)
+    if err != nil {
+        return nil, err
+    }
+
+    response, err := s.cache.get(request.Index, volume, request.Group, func() ([]byte, error) {
+        if exists, err := volume.Exists(uint32(request.Group)); !exists || err != nil {
+            if err != nil {
+                return nil, err
+            }
+            return nil, storage.EntryNotFoundError
+        }
+
+        entry, err := volume.Read(uint32(request.Group))
+        if err != nil {
+            return nil, err
+        }
+
+        return frame(Request{Index: request.Index, Group: request.Group, Urgent: true}, entry)
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    if request.Urgent {
+        return response, nil
+    }
+
+    // The cached response is shared, so it is copied before it is modified.
+    response = append([]byte{}, response...)
+    response[ResponseHeaderLength] |= PrefetchFlag
+    return response, nil
+}
+
+// encrypt returns a response encrypted with a key. The response may be shared, so it is
+// copied before it is encrypted.
+func encrypt(response []byte, key byte) []byte {
+    if key == 0 {
+        return response
+    }
+
+    encrypted := make([]byte, len(response))
+    for i := range response {
+        encrypted[i] = response[i] ^ key
+    }
+    return encrypted
+}
+
+// fail records the error which caused a connection to fail and closes it. Must be called
+// with the mutex held.
+func (s *Server) fail(c *connection, err error) {
+    if c.closed {
+        return
+    }
+
+    c.err = err
+    s.close(c)
+    c.conn.Close()
+}
+
+// close removes a connection from the server, dropping its queued requests and responses.
+// Must be called with the mutex held.
+func (s *Server) close(c *connection) {
+    if c.closed {
+        return
+    }
+
+    c.closed = true
+    c.urgent = nil
+    c.prefetch = nil
+    c.outbound = nil
+    c.inFlight = 0
+    c.writable.Broadcast()
+
+    for i, other := range s.connections {
+        if other == c {
+            s.connections = append(s.connections[:i], s.connections[i+1:]...)
+            if s.next > i {
+                s.next--
+            }
+            break
+        }
+    }
+
+    if len(s.connections) == 0 || s.next >= len(s.connections) {
+        s.next = 0
+    }
+}
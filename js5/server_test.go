@@ -0,0 +1,351 @@
+package js5
+
+import (
+    "testing"
+    "bytes"
+    "io/ioutil"
+    "net"
+    "os"
+    "time"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/internal"
+    "github.com/hadyn/goscape/storage"
+)
+
+const testRevision = 530
+
+// newTestServer creates a server backed by a storage holding the same versioned entry in
+// groups 0 to 5 of volume 2. Returns a function which closes the server and removes the
+// storage.
+func newTestServer(t *testing.T, config Config) (*Server, []byte, func()) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    s, err := storage.NewStorage(dir, storage.Dat2Provider{}, storage.ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := s.Open(2)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    c := &container.Container{
+        Compression: container.None,
+        Bytes:       internal.SequentialBytes(2000),
+        Version:     3,
+        Versioned:   true,
+    }
+
+    entry, err := c.Encode(container.NullKey)
+    if err != nil {
+        t.Fatal("failed to encode the container", err)
+    }
+
+    for group := uint32(0); group <= 5; group++ {
+        if err := volume.Write(group, entry); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    config.Revision = testRevision
+    server := NewServer(s, config)
+    return server, entry[:len(entry)-container.VersionLength], func() {
+        server.Close()
+        s.Close()
+        os.RemoveAll(dir)
+    }
+}
+
+// connect serves a new in process connection and performs the handshake. Returns a channel
+// which receives the result of serving the connection.
+func connect(server *Server, revision uint32) (*Client, <-chan error, error) {
+    clientConn, serverConn := net.Pipe()
+
+    done := make(chan error, 1)
+    go func() {
+        done <- server.ServeConn(serverConn)
+    }()
+
+    client, err := Dial(clientConn, revision)
+    return client, done, err
+}
+
+func TestServerHandshakeOutOfDate(t *testing.T) {
+    server, _, cleanup := newTestServer(t, Config{})
+    defer cleanup()
+
+    if _, done, err := connect(server, testRevision-1); err != OutOfDateError {
+        t.Errorf("expected out of date error, got: %v", err)
+    } else if err := <-done; err != OutOfDateError {
+        t.Errorf("expected the server to fail with out of date error, got: %v", err)
+    }
+}
+
+func TestServerRequest(t *testing.T) {
+    server, expected, cleanup := newTestServer(t, Config{})
+    defer cleanup()
+
+    client, done, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    if err := client.SetLoggedIn(true); err != nil {
+        t.Fatal("failed to send the logged in message", err)
+    }
+
+    for _, urgent := range []bool{true, false} {
+        request := Request{Index: 2, Group: 1, Urgent: urgent}
+        if err := client.Request(request); err != nil {
+            t.Fatal("failed to send the request", err)
+        }
+
+        response, err := client.Receive()
+        if err != nil {
+            t.Fatal("failed to receive the response", err)
+        }
+
+        if response.Request != request {
+            t.Errorf("request mismatch (expected: %v, actual: %v)", request, response.Request)
+        }
+
+        if !bytes.Equal(response.Container, expected) {
+            t.Errorf("container mismatch (urgent: %t)", urgent)
+        }
+    }
+
+    if err := client.Close(); err != nil {
+        t.Fatal("failed to close the client", err)
+    }
+
+    if err := <-done; err != nil {
+        t.Errorf("failed to serve the connection: %s", err)
+    }
+}
+
+func TestServerEncryptionKey(t *testing.T) {
+    server, expected, cleanup := newTestServer(t, Config{})
+    defer cleanup()
+
+    client, _, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    defer client.Close()
+
+    if err := client.SetKey(0x5A); err != nil {
+        t.Fatal("failed to send the key", err)
+    }
+
+    if err := client.Request(Request{Index: 2, Group: 1, Urgent: true}); err != nil {
+        t.Fatal("failed to send the request", err)
+    }
+
+    response, err := client.Receive()
+    if err != nil {
+        t.Fatal("failed to receive the response", err)
+    }
+
+    if !bytes.Equal(response.Container, expected) {
+        t.Error("container mismatch")
+    }
+}
+
+func TestServerMissingGroup(t *testing.T) {
+    server, _, cleanup := newTestServer(t, Config{})
+    defer cleanup()
+
+    client, done, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    if err := client.Request(Request{Index: 2, Group: 100, Urgent: true}); err != nil {
+        t.Fatal("failed to send the request", err)
+    }
+
+    if err := <-done; err != storage.EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+}
+
+func TestServerMissingIndex(t *testing.T) {
+    server, _, cleanup := newTestServer(t, Config{})
+    defer cleanup()
+
+    client, done, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    if err := client.Request(Request{Index: 200, Group: 0, Urgent: true}); err != nil {
+        t.Fatal("failed to send the request", err)
+    }
+
+    if err := <-done; err != storage.EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+
+    exists, err := server.storage.Exists(200)
+    if err != nil {
+        t.Fatal("failed to check the index", err)
+    }
+
+    if exists {
+        t.Error("expected the index not to be created")
+    }
+}
+
+func TestServerUrgentFirst(t *testing.T) {
+    server, _, cleanup := newTestServer(t, Config{Workers: 1, MaxInFlight: 1})
+    defer cleanup()
+
+    client, _, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    defer client.Close()
+
+    for group := uint16(0); group < 5; group++ {
+        if err := client.Request(Request{Index: 2, Group: group}); err != nil {
+            t.Fatal("failed to send the request", err)
+        }
+    }
+
+    // The first response is stuck in flight until the client reads it, so the remaining
+    // requests stay queued.
+    waitForMetrics(t, server, func(metrics Metrics) bool {
+        return metrics.PrefetchQueued == 4 && metrics.InFlight > 0
+    })
+
+    if err := client.Request(Request{Index: 2, Group: 5, Urgent: true}); err != nil {
+        t.Fatal("failed to send the request", err)
+    }
+
+    waitForMetrics(t, server, func(metrics Metrics) bool {
+        return metrics.UrgentQueued == 1
+    })
+
+    expected := []uint16{0, 5, 1, 2, 3, 4}
+    for _, group := range expected {
+        response, err := client.Receive()
+        if err != nil {
+            t.Fatal("failed to receive the response", err)
+        }
+
+        if response.Group != group {
+            t.Errorf("group mismatch (expected: %d, actual: %d)", group, response.Group)
+        }
+    }
+}
+
+func TestServerQueueFull(t *testing.T) {
+    server, _, cleanup := newTestServer(t, Config{Workers: 1, MaxInFlight: 1, MaxQueued: 2})
+    defer cleanup()
+
+    client, done, err := connect(server, testRevision)
+    if err != nil {
+        t.Fatal("failed to connect", err)
+    }
+
+    defer client.Close()
+
+    // The first response is stuck in flight, so at most one request is taken off the queue
+    // and the connection is closed before every request is sent.
+    for group := uint16(0); group < 4; group++ {
+        if err := client.Request(Request{Index: 2, Group: group}); err != nil {
+            break
+        }
+    }
+
+    if err := <-done; err != QueueFullError {
+        t.Errorf("expected queue full error, got: %v", err)
+    }
+}
+
+// waitForMetrics waits until the metrics of the server satisfy the condition.
+func waitForMetrics(t *testing.T, server *Server, condition func(Metrics) bool) {
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        metrics := server.Metrics()
+        if condition(metrics) {
+            return
+        }
+
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for the metrics: %+v", metrics)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestServerSchedule(t *testing.T) {
+    server := &Server{maxInFlight: 10}
+
+    a := &connection{prefetch: []Request{{Group: 0}, {Group: 1}, {Group: 2}}}
+    b := &connection{prefetch: []Request{{Group: 10}, {Group: 11}}}
+    c := &connection{urgent: []Request{{Group: 20, Urgent: true}}}
+    full := &connection{urgent: []Request{{Group: 30, Urgent: true}}, inFlight: 10}
+    server.connections = []*connection{a, b, c, full}
+
+    expected := []uint16{20, 0, 10, 1, 11, 2}
+    for _, group := range expected {
+        conn, request, ok := server.schedule()
+        if !ok {
+            t.Fatalf("expected group %d to be scheduled", group)
+        }
+
+        if request.Group != group {
+            t.Errorf("group mismatch (expected: %d, actual: %d)", group, request.Group)
+        }
+
+        conn.pending--
+    }
+
+    // Nothing more is taken from a connection while its response is being framed.
+    a.prefetch = []Request{{Group: 3}, {Group: 4}}
+    if _, _, ok := server.schedule(); !ok {
+        t.Fatal("expected group 3 to be scheduled")
+    }
+
+    if _, _, ok := server.schedule(); ok {
+        t.Error("expected no request to be scheduled while a response is being framed")
+    }
+    a.prefetch = nil
+    a.pending = 0
+
+    if _, _, ok := server.schedule(); ok {
+        t.Error("expected no request to be scheduled while the connection is full")
+    }
+}
+
+func TestFrame(t *testing.T) {
+    entry, err := container.Pack(internal.SequentialBytes(1200), container.None)
+    if err != nil {
+        t.Fatal("failed to pack the entry", err)
+    }
+
+    response, err := frame(Request{Index: 1, Group: 2}, entry)
+    if err != nil {
+        t.Fatal("failed to frame the entry", err)
+    }
+
+    // Three chunks, two of which are preceded by a marker.
+    if len(response) != ResponseHeaderLength+len(entry)+2 {
+        t.Fatalf("length mismatch (expected: %d, actual: %d)", ResponseHeaderLength+len(entry)+2, len(response))
+    }
+
+    if response[ChunkLength] != ChunkMarker || response[2*ChunkLength] != ChunkMarker {
+        t.Error("chunk marker mismatch")
+    }
+
+    if response[ResponseHeaderLength] != PrefetchFlag {
+        t.Error("expected the prefetch flag to be set")
+    }
+}
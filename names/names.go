@@ -0,0 +1,25 @@
+package names
+
+import (
+    "strings"
+)
+
+// Hash hashes a group or file name the way the client does. Names are case insensitive, so
+// the name is lowercased before it is hashed.
+func Hash(name string) uint32 {
+    hash := uint32(0)
+    for _, c := range strings.ToLower(name) {
+        hash = hash*31 + uint32(c)
+    }
+    return hash
+}
+
+// JagHash hashes the name of a legacy JAG archive entry. Names are case insensitive, so
+// the name is uppercased before it is hashed.
+func JagHash(name string) uint32 {
+    hash := uint32(0)
+    for _, c := range strings.ToUpper(name) {
+        hash = hash*61 + uint32(c) - 32
+    }
+    return hash
+}
@@ -0,0 +1,35 @@
+package names
+
+import (
+    "testing"
+)
+
+func TestHash(t *testing.T) {
+    tests := map[string]uint32{
+        "":        0,
+        "a":       97,
+        "huffman": 1258058669,
+        "HUFFMAN": 1258058669,
+    }
+
+    for name, expected := range tests {
+        if actual := Hash(name); actual != expected {
+            t.Errorf("hash mismatch for %q (expected: %d, actual: %d)", name, expected, actual)
+        }
+    }
+}
+
+func TestJagHash(t *testing.T) {
+    tests := map[string]uint32{
+        "":          0,
+        "A":         33,
+        "a":         33,
+        "index.dat": 2365629959,
+    }
+
+    for name, expected := range tests {
+        if actual := JagHash(name); actual != expected {
+            t.Errorf("hash mismatch for %q (expected: %d, actual: %d)", name, expected, actual)
+        }
+    }
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+    "sort"
+)
+
+// allocator hands out the blocks of a blocks file, reusing blocks which no entry owns
+// before appending blocks to the end of the file. Volumes opened from a storage share an
+// allocator, which scans every volume for the blocks they own the first time a block is
+// needed. An allocator is guarded by the mutex of the volumes which share it.
+type allocator struct {
+    free    []uint32
+    scanned bool
+    scan    func() ([]uint32, error)
+}
+
+// newAllocator creates an allocator which finds the free blocks with the scan function. If
+// the scan function is nil only the blocks released to the allocator are reused.
+func newAllocator(scan func() ([]uint32, error)) *allocator {
+    return &allocator{
+        scanned: scan == nil,
+        scan:    scan,
+    }
+}
+
+// allocate returns the identifiers of the given number of blocks, taking the lowest free
+// blocks first and then blocks from the end of the blocks file of the volume.
+func (a *allocator) allocate(v *Volume, count int) ([]uint32, error) {
+    if !a.scanned {
+        free, err := a.scan()
+        if err != nil {
+            return nil, err
+        }
+
+        a.free = free
+        a.scanned = true
+    }
+
+    next, err := v.nextBlockId()
+    if err != nil {
+        return nil, err
+    }
+
+    // The blocks file may have been truncated since the blocks were freed.
+    for len(a.free) > 0 && a.free[len(a.free)-1] >= next {
+        a.free = a.free[:len(a.free)-1]
+    }
+
+    n := count
+    if n > len(a.free) {
+        n = len(a.free)
+    }
+
+    ids := make([]uint32, 0, count)
+    ids = append(ids, a.free[:n]...)
+    a.free = a.free[n:]
+
+    for len(ids) < count {
+        if next == EndOfEntry {
+            next++
+        }
+        ids = append(ids, next)
+        next++
+    }
+
+    return ids, nil
+}
+
+// release returns blocks which no entry owns any more to the allocator. Blocks past the end
+// of the blocks file are dropped, as they are handed out again when it is appended to.
+func (a *allocator) release(v *Volume, ids []uint32) error {
+    // Scanning finds every released block.
+    if !a.scanned {
+        return nil
+    }
+
+    next, err := v.nextBlockId()
+    if err != nil {
+        return err
+    }
+
+    for _, id := range ids {
+        if id == EndOfEntry || id >= next {
+            continue
+        }
+
+        i := sort.Search(len(a.free), func(i int) bool { return a.free[i] >= id })
+        if i < len(a.free) && a.free[i] == id {
+            continue
+        }
+
+        a.free = append(a.free, 0)
+        copy(a.free[i+1:], a.free[i:])
+        a.free[i] = id
+    }
+
+    return nil
+}
+
+// reset forgets the free blocks so that they are scanned for again.
+func (a *allocator) reset() {
+    a.free = nil
+    a.scanned = a.scan == nil
+}
+
+// freeBlocks returns the blocks which no entry of any volume owns, in ascending order. Must
+// be called with the mutex held.
+func (s *Storage) freeBlocks() ([]uint32, error) {
+    ids, err := s.indexes()
+    if err != nil {
+        return nil, err
+    }
+
+    size, err := s.blocks.Size()
+    if err != nil {
+        return nil, err
+    }
+
+    owned := make([]bool, (size+BlockLength-1)/BlockLength)
+    for _, id := range ids {
+        volume, err := s.open(id)
+        if err != nil {
+            return nil, err
+        }
+
+        count, err := volume.count()
+        if err != nil {
+            return nil, err
+        }
+
+        for entryId := uint32(0); entryId < count; entryId++ {
+            ref, err := volume.readReference(entryId)
+            if err != nil {
+                return nil, err
+            }
+
+            blockIds, err := volume.chain(ref)
+            if err != nil {
+                return nil, err
+            }
+
+            for _, blockId := range blockIds {
+                if int(blockId) < len(owned) {
+                    owned[blockId] = true
+                }
+            }
+        }
+    }
+
+    var free []uint32
+    for id := 1; id < len(owned); id++ {
+        if !owned[id] {
+            free = append(free, uint32(id))
+        }
+    }
+    return free, nil
+}
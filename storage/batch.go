@@ -0,0 +1,251 @@
+package storage
+
+import (
+    "io"
+    "os"
+    "path"
+    "reflect"
+    "sort"
+    "sync"
+)
+
+// Batch stages writes to one or more volumes so that they are either all applied or none
+// of them are. Committing a batch writes the blocks of every entry to blocks which no entry
+// owns, leaving the existing blocks untouched, and only updates the references once every
+// block has been written. If an error occurs the volumes are rolled back to how they were
+// before the commit.
+//
+// A batch created by a storage journals the references before writing them, so if the
+// process crashes while they are being written the batch is completed the next time the
+// storage is opened in read-write mode. A batch created with NewBatch has no journal, so a
+// crash while writing its references can leave only some of the writes applied.
+type Batch struct {
+    writes  []stagedWrite
+    journal string
+}
+
+type stagedWrite struct {
+    volume *Volume
+    id     uint32
+    buffer []byte
+}
+
+type entryKey struct {
+    volume *Volume
+    id     uint32
+}
+
+// snapshot records how a store looked before a batch was committed.
+type snapshot struct {
+    store Store
+    size  int64
+}
+
+func NewBatch() *Batch {
+    return &Batch{}
+}
+
+// NewBatch creates a journaled batch for volumes of the storage.
+func (s *Storage) NewBatch() *Batch {
+    return &Batch{journal: path.Join(s.root, journalName)}
+}
+
+// Write stages a write of an entry. Nothing is written until the batch is committed.
+func (b *Batch) Write(volume *Volume, id uint32, buffer []byte) {
+    b.writes = append(b.writes, stagedWrite{volume, id, buffer})
+}
+
+// Commit applies every staged write.
+func (b *Batch) Commit() error {
+    unlock := b.lock()
+    defer unlock()
+
+    blocks, err := b.snapshot(func(v *Volume) Store { return v.blocks })
+    if err != nil {
+        return err
+    }
+
+    references, err := b.snapshot(func(v *Volume) Store { return v.references })
+    if err != nil {
+        return err
+    }
+
+    // Keep the previous references so they can be restored if committing fails, and their
+    // blocks so they can be reused once it succeeds.
+    previous := make([]*Reference, len(b.writes))
+    orphaned := make(map[*Volume][]uint32)
+    for i, write := range b.writes {
+        ref, err := write.volume.readReference(write.id)
+        if err != nil && err != io.EOF {
+            return err
+        }
+
+        if err != nil {
+            continue
+        }
+        previous[i] = &ref
+
+        blockIds, err := write.volume.chain(ref)
+        if err != nil {
+            return err
+        }
+        orphaned[write.volume] = append(orphaned[write.volume], blockIds...)
+    }
+
+    refs := make([]Reference, len(b.writes))
+    written := make([][]uint32, len(b.writes))
+    release := func() {
+        for i, write := range b.writes {
+            write.volume.allocator.release(write.volume, written[i])
+        }
+    }
+
+    for i, write := range b.writes {
+        ref, blockIds, err := write.volume.writeBlocks(write.id, write.buffer)
+        if err != nil {
+            rollback(blocks)
+            release()
+            return err
+        }
+        refs[i] = ref
+        written[i] = blockIds
+    }
+
+    for _, snapshot := range blocks {
+        if err := syncStore(snapshot.store); err != nil {
+            rollback(blocks)
+            release()
+            return err
+        }
+    }
+
+    if b.journal != "" {
+        if err := writeJournal(b.journal, b.writes, refs); err != nil {
+            rollback(blocks)
+            release()
+            return err
+        }
+    }
+
+    for i, write := range b.writes {
+        if err := write.volume.writeReference(refs[i]); err != nil {
+            // Restore the references which have already been written.
+            for j := i - 1; j >= 0; j-- {
+                if previous[j] != nil {
+                    b.writes[j].volume.writeReference(*previous[j])
+                }
+            }
+            rollback(references)
+            rollback(blocks)
+            release()
+
+            if b.journal != "" {
+                os.Remove(b.journal)
+            }
+            return err
+        }
+    }
+
+    for _, write := range b.writes {
+        write.volume.notify(write.id)
+    }
+
+    for _, snapshot := range references {
+        if err := syncStore(snapshot.store); err != nil {
+            return err
+        }
+    }
+
+    if b.journal != "" {
+        if err := os.Remove(b.journal); err != nil {
+            return err
+        }
+    }
+
+    // An entry written more than once only keeps the blocks of its last write.
+    last := make(map[entryKey]int)
+    for i, write := range b.writes {
+        last[entryKey{write.volume, write.id}] = i
+    }
+
+    owned := make(map[uint32]bool)
+    for i, write := range b.writes {
+        if last[entryKey{write.volume, write.id}] != i {
+            orphaned[write.volume] = append(orphaned[write.volume], written[i]...)
+            continue
+        }
+
+        for _, blockId := range written[i] {
+            owned[blockId] = true
+        }
+    }
+
+    for volume, blockIds := range orphaned {
+        var free []uint32
+        for _, blockId := range blockIds {
+            if !owned[blockId] {
+                free = append(free, blockId)
+            }
+        }
+
+        if err := volume.allocator.release(volume, free); err != nil {
+            return err
+        }
+    }
+
+    b.writes = nil
+    return nil
+}
+
+// lock locks the mutex of every volume in the batch, in a consistent order to avoid
+// deadlocking with other batches. Returns a function which unlocks them.
+func (b *Batch) lock() func() {
+    seen := make(map[*sync.RWMutex]bool)
+    var mutexes []*sync.RWMutex
+    for _, write := range b.writes {
+        if !seen[write.volume.mutex] {
+            seen[write.volume.mutex] = true
+            mutexes = append(mutexes, write.volume.mutex)
+        }
+    }
+
+    sort.Slice(mutexes, func(i, j int) bool {
+        return reflect.ValueOf(mutexes[i]).Pointer() < reflect.ValueOf(mutexes[j]).Pointer()
+    })
+
+    for _, mutex := range mutexes {
+        mutex.Lock()
+    }
+
+    return func() {
+        for i := len(mutexes) - 1; i >= 0; i-- {
+            mutexes[i].Unlock()
+        }
+    }
+}
+
+func (b *Batch) snapshot(store func(*Volume) Store) ([]snapshot, error) {
+    seen := make(map[Store]bool)
+    var snapshots []snapshot
+    for _, write := range b.writes {
+        s := store(write.volume)
+        if seen[s] {
+            continue
+        }
+        seen[s] = true
+
+        size, err := s.Size()
+        if err != nil {
+            return nil, err
+        }
+        snapshots = append(snapshots, snapshot{s, size})
+    }
+    return snapshots, nil
+}
+
+// rollback truncates each store back to the size it was before committing.
+func rollback(snapshots []snapshot) {
+    for _, snapshot := range snapshots {
+        snapshot.store.Truncate(snapshot.size)
+    }
+}
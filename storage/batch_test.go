@@ -0,0 +1,161 @@
+package storage
+
+import (
+    "testing"
+    "bytes"
+    "errors"
+    "io/ioutil"
+    "os"
+    "sync"
+)
+
+// failingStore is a store which fails every write after a number of writes.
+type failingStore struct {
+    *MemoryStore
+    remaining int
+}
+
+func (f *failingStore) WriteAt(buffer []byte, offset int64) (int, error) {
+    if f.remaining == 0 {
+        return 0, errors.New("write failed")
+    }
+    f.remaining--
+    return f.MemoryStore.WriteAt(buffer, offset)
+}
+
+func TestBatchCommit(t *testing.T) {
+    mutex := &sync.RWMutex{}
+    blocks := NewMemoryStore(nil)
+    first := NewVolume(0, NewMemoryStore(nil), blocks, mutex)
+    second := NewVolume(1, NewMemoryStore(nil), blocks, &sync.RWMutex{})
+
+    batch := NewBatch()
+    batch.Write(first, 0, []byte("Hello"))
+    batch.Write(second, 3, []byte("world!"))
+    batch.Write(first, 0, []byte("Goodbye"))
+
+    if err := batch.Commit(); err != nil {
+        t.Fatal("failed to commit the batch", err)
+    }
+
+    for _, expected := range []struct {
+        volume   *Volume
+        id       uint32
+        contents string
+    }{{first, 0, "Goodbye"}, {second, 3, "world!"}} {
+        entry, err := expected.volume.Read(expected.id)
+        if err != nil {
+            t.Fatal("failed to read the entry", err)
+        }
+
+        if !bytes.Equal(entry, []byte(expected.contents)) {
+            t.Errorf("contents mismatch (expected: %s, actual: %s)", expected.contents, entry)
+        }
+    }
+}
+
+func TestBatchRollback(t *testing.T) {
+    blocks := NewMemoryStore(nil)
+    first := NewVolume(0, NewMemoryStore(nil), blocks, &sync.RWMutex{})
+    if err := first.Write(0, []byte("original")); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    // The second volume fails when its reference is written, after every block has been written.
+    second := NewVolume(1, &failingStore{NewMemoryStore(nil), 0}, blocks, &sync.RWMutex{})
+
+    size, _ := blocks.Size()
+
+    batch := NewBatch()
+    batch.Write(first, 0, []byte("modified"))
+    batch.Write(second, 0, []byte("new"))
+
+    if err := batch.Commit(); err == nil {
+        t.Fatal("expected the commit to fail")
+    }
+
+    entry, err := first.Read(0)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, []byte("original")) {
+        t.Errorf("contents mismatch (expected: %s, actual: %s)", "original", entry)
+    }
+
+    if rolledBack, _ := blocks.Size(); rolledBack != size {
+        t.Errorf("blocks length mismatch (expected: %d, actual: %d)", size, rolledBack)
+    }
+}
+
+func TestBatchJournalReplayed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if err := volume.Write(0, []byte("original")); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    // Write the blocks and the journal of a batch, but crash before writing the reference.
+    batch := storage.NewBatch()
+    batch.Write(volume, 0, []byte("modified"))
+
+    ref, _, err := volume.writeBlocks(0, []byte("modified"))
+    if err != nil {
+        t.Fatal("failed to write the blocks", err)
+    }
+
+    if err := writeJournal(batch.journal, batch.writes, []Reference{ref}); err != nil {
+        t.Fatal("failed to write the journal", err)
+    }
+
+    storage.Close()
+
+    if storage, err = NewStorage(dir, testProvider{}, ReadWrite); err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    if volume, err = storage.Open(0); err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    entry, err := volume.Read(0)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, []byte("modified")) {
+        t.Errorf("contents mismatch (expected: %s, actual: %s)", "modified", entry)
+    }
+
+    if _, err := os.Stat(batch.journal); !os.IsNotExist(err) {
+        t.Error("expected the journal to be removed")
+    }
+
+    // A committed batch leaves no journal behind.
+    batch = storage.NewBatch()
+    batch.Write(volume, 1, []byte("committed"))
+    if err := batch.Commit(); err != nil {
+        t.Fatal("failed to commit the batch", err)
+    }
+
+    if _, err := os.Stat(batch.journal); !os.IsNotExist(err) {
+        t.Error("expected the journal to be removed")
+    }
+}
@@ -7,22 +7,25 @@ import (
 )
 
 const (
-    BlockHeaderLength = 8
-    BlockLength       = 520
-    BytesPerBlock     = BlockLength - BlockHeaderLength
-    EndOfEntry        = 0
+    BlockHeaderLength         = 8
+    ExtendedBlockHeaderLength = 10
+    BlockLength               = 520
+    BytesPerBlock             = BlockLength - BlockHeaderLength
+    BytesPerExtendedBlock     = BlockLength - ExtendedBlockHeaderLength
+    MaxEntryId                = 0xFFFF
+    EndOfEntry                = 0
 )
 
 type Block struct {
     id          uint32
     volumeId    uint8
-    entryId     uint16
+    entryId     uint32
     part        uint16
     nextBlockId uint32
     bytes       []byte
 }
 
-func (b *Block) Validate(storageId uint8, entryId uint16, part uint16) (error) {
+func (b *Block) Validate(storageId uint8, entryId uint32, part uint16) (error) {
     if storageId != b.volumeId || entryId != b.entryId || part != b.part {
         return errors.New(fmt.Sprintf(
             "block header mismatch: Storage: (expected: %d, actual: %d), Entry: (expected: %d, actual: %d), "+
@@ -33,9 +36,57 @@ func (b *Block) Validate(storageId uint8, entryId uint16, part uint16) (error) {
 
 func (b *Block) Write(buffer []byte) {
     _ = buffer[BlockLength-1]
-    types.BigEndian.PutUint16(buffer[0:], b.entryId)
+    if IsExtended(b.entryId) {
+        types.BigEndian.PutUint32(buffer[0:], b.entryId)
+        types.BigEndian.PutUint16(buffer[4:], b.part)
+        types.BigEndian.PutUint24(buffer[6:], b.nextBlockId)
+        buffer[9] = b.volumeId
+        copy(buffer[ExtendedBlockHeaderLength:], b.bytes)
+        return
+    }
+
+    types.BigEndian.PutUint16(buffer[0:], uint16(b.entryId))
     types.BigEndian.PutUint16(buffer[2:], b.part)
     types.BigEndian.PutUint24(buffer[4:], b.nextBlockId)
     buffer[7] = b.volumeId
     copy(buffer[8:], b.bytes)
 }
+
+// ReadBlock decodes a block, using the extended header if the entry it belongs to
+// requires it.
+func ReadBlock(id uint32, entryId uint32, buffer []byte) Block {
+    _ = buffer[BlockLength-1]
+    if IsExtended(entryId) {
+        return Block{
+            id:          id,
+            volumeId:    buffer[9],
+            entryId:     types.BigEndian.Uint32(buffer[0:]),
+            part:        types.BigEndian.Uint16(buffer[4:]),
+            nextBlockId: types.BigEndian.Uint24(buffer[6:]),
+            bytes:       buffer[ExtendedBlockHeaderLength:],
+        }
+    }
+
+    return Block{
+        id:          id,
+        volumeId:    buffer[7],
+        entryId:     uint32(types.BigEndian.Uint16(buffer[0:])),
+        part:        types.BigEndian.Uint16(buffer[2:]),
+        nextBlockId: types.BigEndian.Uint24(buffer[4:]),
+        bytes:       buffer[BlockHeaderLength:],
+    }
+}
+
+// IsExtended returns whether the blocks of an entry use the extended header, which
+// is required for entry identifiers that do not fit in 16 bits.
+func IsExtended(entryId uint32) bool {
+    return entryId > MaxEntryId
+}
+
+// Capacity returns the number of bytes each block of an entry can hold.
+func Capacity(entryId uint32) uint32 {
+    if IsExtended(entryId) {
+        return BytesPerExtendedBlock
+    }
+    return BytesPerBlock
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+    "errors"
+    "hash/crc32"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/types"
+    "github.com/jzelinskie/whirlpool"
+)
+
+const (
+    ChecksumTableId = 255
+)
+
+var (
+    TruncatedChecksumTableError = errors.New("truncated checksum table")
+)
+
+// Digest holds the digests the client uses to check an entry it has downloaded.
+type Digest struct {
+    Crc       uint32
+    Whirlpool [WhirlpoolLength]byte
+}
+
+// ChecksumTable lists the digest and revision of the reference table of every volume. The
+// client downloads it first to determine which reference tables have changed. If the table
+// has a key, the whirlpool digest of the table is encrypted with it and appended so that
+// clients which know the public key can check the table has not been tampered with.
+type ChecksumTable struct {
+    Whirlpool bool
+    Key       *ChecksumKey
+    Entries   []ChecksumEntry
+}
+
+type ChecksumEntry struct {
+    Digest
+    Revision uint32
+}
+
+// DigestEntry computes the digests of an entry as read from a volume. The version trailer
+// of the entry is not covered by the digests, as the client never receives it.
+func DigestEntry(entry []byte) (Digest, error) {
+    length, err := container.PackedLength(entry)
+    if err != nil {
+        return Digest{}, err
+    }
+
+    digest := Digest{Crc: crc32.ChecksumIEEE(entry[:length])}
+
+    hash := whirlpool.New()
+    hash.Write(entry[:length])
+    copy(digest.Whirlpool[:], hash.Sum(nil))
+
+    return digest, nil
+}
+
+// BuildChecksumTable builds the checksum table from the reference table of every volume.
+// Volumes without a reference table are left with an empty entry.
+func (s *Storage) BuildChecksumTable(whirlpool bool) (*ChecksumTable, error) {
+    volume, err := s.Open(ReferenceTableVolume)
+    if err != nil {
+        return nil, err
+    }
+
+    volume.mutex.RLock()
+    defer volume.mutex.RUnlock()
+
+    count, err := volume.count()
+    if err != nil {
+        return nil, err
+    }
+
+    // The checksum table is stored alongside the reference tables, but does not describe
+    // itself.
+    if count > ChecksumTableId {
+        count = ChecksumTableId
+    }
+
+    // Trailing volumes without a reference table are left out.
+    length := uint32(0)
+    table := &ChecksumTable{Whirlpool: whirlpool, Entries: make([]ChecksumEntry, count)}
+    for id := uint32(0); id < count; id++ {
+        if exists, err := volume.contains(id); !exists || err != nil {
+            if err != nil {
+                return nil, err
+            }
+            continue
+        }
+
+        buffer, err := volume.read(id)
+        if err != nil {
+            return nil, err
+        }
+
+        digest, err := DigestEntry(buffer)
+        if err != nil {
+            return nil, err
+        }
+
+        if !whirlpool {
+            digest.Whirlpool = [WhirlpoolLength]byte{}
+        }
+
+        unpacked, err := container.Unpack(buffer)
+        if err != nil {
+            return nil, err
+        }
+
+        reference, err := DecodeReferenceTable(unpacked)
+        if err != nil {
+            return nil, err
+        }
+
+        table.Entries[id] = ChecksumEntry{Digest: digest, Revision: reference.Revision}
+        length = id + 1
+    }
+
+    table.Entries = table.Entries[:length]
+    return table, nil
+}
+
+// RebuildChecksumTable builds the checksum table and writes it to the reference table
+// volume, signing it with the key if one is given.
+func (s *Storage) RebuildChecksumTable(whirlpool bool, key *ChecksumKey) (*ChecksumTable, error) {
+    table, err := s.BuildChecksumTable(whirlpool)
+    if err != nil {
+        return nil, err
+    }
+    table.Key = key
+
+    encoded, err := table.Encode()
+    if err != nil {
+        return nil, err
+    }
+
+    packed, err := container.Pack(encoded, container.None)
+    if err != nil {
+        return nil, err
+    }
+
+    volume, err := s.Open(ReferenceTableVolume)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := volume.Write(ChecksumTableId, packed); err != nil {
+        return nil, err
+    }
+
+    return table, nil
+}
+
+// DecodeChecksumTable decodes an unpacked checksum table. Tables with whirlpool digests
+// begin with a count of their entries, otherwise the count is implied by the length. The
+// signature of a signed table is not checked.
+func DecodeChecksumTable(buffer []byte, whirlpool bool) (*ChecksumTable, error) {
+    entryLength := 8
+    count := len(buffer) / entryLength
+    if whirlpool {
+        if len(buffer) < 1 {
+            return nil, TruncatedChecksumTableError
+        }
+
+        entryLength += WhirlpoolLength
+        count = int(buffer[0])
+        buffer = buffer[1:]
+    }
+
+    if len(buffer) < count*entryLength {
+        return nil, TruncatedChecksumTableError
+    }
+
+    table := &ChecksumTable{Whirlpool: whirlpool, Entries: make([]ChecksumEntry, count)}
+    for i := range table.Entries {
+        entry := &table.Entries[i]
+        entry.Crc = types.BigEndian.Uint32(buffer[0:])
+        entry.Revision = types.BigEndian.Uint32(buffer[4:])
+        if whirlpool {
+            copy(entry.Whirlpool[:], buffer[8:])
+        }
+        buffer = buffer[entryLength:]
+    }
+
+    return table, nil
+}
+
+// Encode encodes the checksum table.
+func (t *ChecksumTable) Encode() ([]byte, error) {
+    if t.Key != nil && !t.Whirlpool {
+        return nil, errors.New("only checksum tables with whirlpool digests can be signed")
+    }
+
+    entryLength := 8
+    offset := 0
+    if t.Whirlpool {
+        if len(t.Entries) > 0xFF {
+            return nil, errors.New("too many checksum table entries")
+        }
+
+        entryLength += WhirlpoolLength
+        offset = 1
+    }
+
+    buffer := make([]byte, offset+len(t.Entries)*entryLength)
+    if t.Whirlpool {
+        buffer[0] = byte(len(t.Entries))
+    }
+
+    for _, entry := range t.Entries {
+        types.BigEndian.PutUint32(buffer[offset:], entry.Crc)
+        types.BigEndian.PutUint32(buffer[offset+4:], entry.Revision)
+        if t.Whirlpool {
+            copy(buffer[offset+8:], entry.Whirlpool[:])
+        }
+        offset += entryLength
+    }
+
+    if t.Key == nil {
+        return buffer, nil
+    }
+
+    signature, err := t.Key.sign(buffer)
+    if err != nil {
+        return nil, err
+    }
+
+    return append(buffer, signature...), nil
+}
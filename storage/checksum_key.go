@@ -0,0 +1,103 @@
+package storage
+
+import (
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "io/ioutil"
+    "math/big"
+    "github.com/jzelinskie/whirlpool"
+)
+
+// signatureMarker is the first byte of the plaintext of the signature.
+const signatureMarker = 10
+
+var (
+    InvalidKeyError = errors.New("invalid checksum key")
+)
+
+// ChecksumKey is the private key the checksum table is signed with. The client holds the
+// matching public exponent and modulus.
+type ChecksumKey struct {
+    Modulus  *big.Int
+    Exponent *big.Int
+}
+
+func NewChecksumKey(modulus *big.Int, exponent *big.Int) *ChecksumKey {
+    return &ChecksumKey{
+        Modulus:  modulus,
+        Exponent: exponent,
+    }
+}
+
+// ParseChecksumKey parses a PEM encoded PKCS #1 or PKCS #8 RSA private key.
+func ParseChecksumKey(data []byte) (*ChecksumKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, InvalidKeyError
+    }
+
+    var key *rsa.PrivateKey
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        key = parsed
+    case "PRIVATE KEY":
+        parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+
+        var ok bool
+        if key, ok = parsed.(*rsa.PrivateKey); !ok {
+            return nil, InvalidKeyError
+        }
+    default:
+        return nil, InvalidKeyError
+    }
+
+    return NewChecksumKey(key.N, key.D), nil
+}
+
+// LoadChecksumKey reads and parses a PEM encoded private key file.
+func LoadChecksumKey(path string) (*ChecksumKey, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    return ParseChecksumKey(data)
+}
+
+// sign encrypts the whirlpool digest of a buffer with the key. The digest is prefixed with a
+// non-zero byte so the decrypted block is always the same length, as leading zeroes are lost
+// when it is decrypted, and the result is encoded the way Java encodes a BigInteger.
+func (k *ChecksumKey) sign(buffer []byte) ([]byte, error) {
+    if k.Modulus == nil || k.Exponent == nil || k.Modulus.Sign() <= 0 {
+        return nil, InvalidKeyError
+    }
+
+    hash := whirlpool.New()
+    hash.Write(buffer)
+
+    plaintext := append([]byte{signatureMarker}, hash.Sum(nil)...)
+    message := new(big.Int).SetBytes(plaintext)
+    if message.Cmp(k.Modulus) >= 0 {
+        return nil, errors.New("checksum key modulus is too small")
+    }
+
+    return signedBytes(new(big.Int).Exp(message, k.Exponent, k.Modulus)), nil
+}
+
+// signedBytes encodes a non-negative integer as a two's complement big endian integer.
+func signedBytes(value *big.Int) []byte {
+    bytes := value.Bytes()
+    if len(bytes) == 0 || bytes[0]&0x80 != 0 {
+        bytes = append([]byte{0}, bytes...)
+    }
+    return bytes
+}
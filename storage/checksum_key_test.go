@@ -0,0 +1,88 @@
+package storage
+
+import (
+    "testing"
+    "bytes"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/pem"
+    "math/big"
+    "github.com/jzelinskie/whirlpool"
+)
+
+func TestParseChecksumKey(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+        t.Fatal("failed to generate the key", err)
+    }
+
+    pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        t.Fatal("failed to marshal the key", err)
+    }
+
+    blocks := []*pem.Block{
+        {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+        {Type: "PRIVATE KEY", Bytes: pkcs8},
+    }
+
+    for _, block := range blocks {
+        parsed, err := ParseChecksumKey(pem.EncodeToMemory(block))
+        if err != nil {
+            t.Fatalf("failed to parse the %s: %s", block.Type, err)
+        }
+
+        if parsed.Modulus.Cmp(key.N) != 0 || parsed.Exponent.Cmp(key.D) != 0 {
+            t.Errorf("key mismatch for %s", block.Type)
+        }
+    }
+
+    if _, err := ParseChecksumKey([]byte("invalid")); err != InvalidKeyError {
+        t.Errorf("expected invalid key error, got: %v", err)
+    }
+}
+
+func TestChecksumTableSigned(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 1024)
+    if err != nil {
+        t.Fatal("failed to generate the key", err)
+    }
+
+    table := &ChecksumTable{
+        Whirlpool: true,
+        Key:       NewChecksumKey(key.N, key.D),
+        Entries:   []ChecksumEntry{{Digest: Digest{Crc: 1}, Revision: 2}, {}},
+    }
+
+    encoded, err := table.Encode()
+    if err != nil {
+        t.Fatal("failed to encode the table", err)
+    }
+
+    length := 1 + len(table.Entries)*(8+WhirlpoolLength)
+    if _, err := DecodeChecksumTable(encoded, true); err != nil {
+        t.Fatal("failed to decode the table", err)
+    }
+
+    // Decrypt the signature with the public key the way the client does.
+    signature := new(big.Int).SetBytes(encoded[length:])
+    decrypted := new(big.Int).Exp(signature, big.NewInt(int64(key.E)), key.N).Bytes()
+
+    hash := whirlpool.New()
+    hash.Write(encoded[:length])
+    digest := hash.Sum(nil)
+
+    if len(decrypted) != 1+WhirlpoolLength || decrypted[0] != signatureMarker {
+        t.Fatalf("unexpected signature layout (length: %d)", len(decrypted))
+    }
+
+    if !bytes.Equal(decrypted[1:], digest) {
+        t.Error("signature mismatch")
+    }
+
+    table.Whirlpool = false
+    if _, err := table.Encode(); err == nil {
+        t.Error("expected an error signing a table without whirlpool digests")
+    }
+}
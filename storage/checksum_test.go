@@ -0,0 +1,125 @@
+package storage
+
+import (
+    "testing"
+    "encoding/hex"
+    "hash/crc32"
+    "io/ioutil"
+    "os"
+    "github.com/hadyn/goscape/container"
+)
+
+func TestDigestEntry(t *testing.T) {
+    packed, err := container.Pack([]byte("abc"), container.None)
+    if err != nil {
+        t.Fatal("failed to pack the entry", err)
+    }
+
+    digest, err := DigestEntry(packed)
+    if err != nil {
+        t.Fatal("failed to digest the entry", err)
+    }
+
+    if digest.Crc != crc32.ChecksumIEEE(packed) {
+        t.Errorf("crc mismatch (expected: %d, actual: %d)", crc32.ChecksumIEEE(packed), digest.Crc)
+    }
+
+    // The version trailer is not covered by the digests.
+    versioned := append(append([]byte{}, packed...), 0, 7)
+    other, err := DigestEntry(versioned)
+    if err != nil {
+        t.Fatal("failed to digest the entry", err)
+    }
+
+    if other != digest {
+        t.Error("digest mismatch with version trailer")
+    }
+}
+
+func TestDigestEntryWhirlpool(t *testing.T) {
+    // The whirlpool digest of an empty uncompressed container.
+    digest, err := DigestEntry([]byte{0, 0, 0, 0, 0})
+    if err != nil {
+        t.Fatal("failed to digest the entry", err)
+    }
+
+    expected := "4a1d1d8380f38896b6fc5788c559f92727acfd4dfa7081c72302b17e1ed437b3" +
+        "0a24cfd75a16fd71b6bf5aa7ae5c7084594e3003a0b71584dc993681f902df6f"
+    if actual := hex.EncodeToString(digest.Whirlpool[:]); actual != expected {
+        t.Errorf("whirlpool mismatch (expected: %s, actual: %s)", expected, actual)
+    }
+}
+
+func TestStorageRebuildChecksumTable(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    for _, id := range []uint8{0, 2} {
+        table := &ReferenceTable{Format: RevisionedFormat, Revision: uint32(id) + 10}
+        if err := storage.WriteReferenceTable(id, table, container.Gzip); err != nil {
+            t.Fatal("failed to write the table", err)
+        }
+    }
+
+    for _, whirlpool := range []bool{false, true} {
+        table, err := storage.RebuildChecksumTable(whirlpool, nil)
+        if err != nil {
+            t.Fatal("failed to rebuild the checksum table", err)
+        }
+
+        volume, err := storage.Open(ReferenceTableVolume)
+        if err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+
+        buffer, err := volume.Read(ChecksumTableId)
+        if err != nil {
+            t.Fatal("failed to read the checksum table", err)
+        }
+
+        unpacked, err := container.Unpack(buffer)
+        if err != nil {
+            t.Fatal("failed to unpack the checksum table", err)
+        }
+
+        decoded, err := DecodeChecksumTable(unpacked, whirlpool)
+        if err != nil {
+            t.Fatal("failed to decode the checksum table", err)
+        }
+
+        if len(decoded.Entries) != 3 || len(table.Entries) != 3 {
+            t.Fatalf("entry count mismatch (expected: %d, actual: %d)", 3, len(decoded.Entries))
+        }
+
+        for id, entry := range decoded.Entries {
+            if entry != table.Entries[id] {
+                t.Errorf("entry %d mismatch", id)
+            }
+        }
+
+        tableBuffer, _ := volume.Read(2)
+        digest, _ := DigestEntry(tableBuffer)
+        if decoded.Entries[2].Crc != digest.Crc || decoded.Entries[2].Revision != 12 {
+            t.Error("entry 2 mismatch")
+        }
+
+        if whirlpool && decoded.Entries[2].Whirlpool != digest.Whirlpool {
+            t.Error("whirlpool mismatch")
+        }
+
+        if decoded.Entries[1] != (ChecksumEntry{}) {
+            t.Error("expected an empty entry for a missing table")
+        }
+    }
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+    "os"
+    "path"
+)
+
+const (
+    compactSuffix = ".compact"
+    backupSuffix  = ".old"
+)
+
+// Compact rewrites the blocks file and every index file so that the blocks of each entry
+// are contiguous, discarding any blocks which are no longer referenced. The compacted files
+// are written alongside the originals and only swapped in once every entry has been copied.
+// While swapping, each original is kept as a backup and restored if a later file fails to
+// swap, so the cache is left untouched if an error occurs. If the process is interrupted
+// part way through swapping, the originals remain on disk with a .old suffix. Opened
+// volumes are switched over to the compacted files. Returns the number of bytes reclaimed.
+//
+// Writes reuse blocks which no entry owns, so the blocks file only grows once every free
+// block is in use. Compacting also shrinks the blocks file and makes every entry contiguous.
+func (s *Storage) Compact() (int64, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.mode != ReadWrite {
+        return 0, ReadOnlyError
+    }
+
+    ids, err := s.indexes()
+    if err != nil {
+        return 0, err
+    }
+
+    var created []string
+    cleanup := func() {
+        for _, name := range created {
+            os.Remove(name + compactSuffix)
+        }
+    }
+
+    create := func(name string) (*FileStore, error) {
+        file, err := os.Create(name + compactSuffix)
+        if err != nil {
+            return nil, err
+        }
+        created = append(created, name)
+        return NewFileStore(file), nil
+    }
+
+    blocksName := path.Join(s.root, s.provider.blocks())
+    blocks, err := create(blocksName)
+    if err != nil {
+        cleanup()
+        return 0, err
+    }
+    defer blocks.Close()
+
+    before, err := s.blocks.Size()
+    if err != nil {
+        cleanup()
+        return 0, err
+    }
+
+    for _, id := range ids {
+        volume, err := s.open(id)
+        if err != nil {
+            cleanup()
+            return 0, err
+        }
+
+        references, err := create(s.indexPath(id))
+        if err != nil {
+            cleanup()
+            return 0, err
+        }
+
+        // The compacted volumes append to the compacted blocks file rather than reusing the
+        // free blocks of the original.
+        destination := s.volume(id, references, blocks)
+        destination.allocator = newAllocator(nil)
+
+        err = compactVolume(volume, destination)
+        references.Close()
+
+        if err != nil {
+            cleanup()
+            return 0, err
+        }
+    }
+
+    if err := blocks.Sync(); err != nil {
+        cleanup()
+        return 0, err
+    }
+
+    after, err := blocks.Size()
+    if err != nil {
+        cleanup()
+        return 0, err
+    }
+
+    // Swap the compacted files in, finishing with the blocks file.
+    var swapped []string
+    for i := len(created) - 1; i >= 0; i-- {
+        if err := swap(created[i]); err != nil {
+            for j := len(swapped) - 1; j >= 0; j-- {
+                restore(swapped[j])
+            }
+            cleanup()
+            return 0, err
+        }
+        swapped = append(swapped, created[i])
+    }
+
+    for _, name := range swapped {
+        os.Remove(name + backupSuffix)
+    }
+
+    s.allocator.reset()
+
+    closeStore(s.blocks)
+    if s.blocks, err = s.mode.openBlocks(blocksName); err != nil {
+        return 0, err
+    }
+
+    for id, volume := range s.volumes {
+        closeStore(volume.references)
+        if volume.references, err = s.mode.open(s.indexPath(id)); err != nil {
+            delete(s.volumes, id)
+            return 0, err
+        }
+        volume.blocks = s.blocks
+    }
+
+    return before - after, nil
+}
+
+// swap moves a file aside as a backup and renames its compacted file over it. If the
+// rename fails the backup is moved back.
+func swap(name string) error {
+    if err := os.Rename(name, name+backupSuffix); err != nil {
+        return err
+    }
+
+    if err := os.Rename(name+compactSuffix, name); err != nil {
+        os.Rename(name+backupSuffix, name)
+        return err
+    }
+
+    return nil
+}
+
+// restore moves the backup of a swapped file back, keeping the compacted file so it can be
+// cleaned up.
+func restore(name string) error {
+    if err := os.Rename(name, name+compactSuffix); err != nil {
+        return err
+    }
+    return os.Rename(name+backupSuffix, name)
+}
+
+// compactVolume copies every entry of a volume into the destination volume, appending
+// each entry to the end of the destination blocks.
+func compactVolume(source *Volume, destination *Volume) error {
+    length, err := source.references.Size()
+    if err != nil {
+        return err
+    }
+
+    if err := destination.references.Truncate(length); err != nil {
+        return err
+    }
+
+    count := uint32(length / ReferenceLength)
+    for entryId := uint32(0); entryId < count; entryId++ {
+        ref, err := source.readReference(entryId)
+        if err != nil {
+            return err
+        }
+
+        if ref.length == 0 || ref.blockId == EndOfEntry {
+            continue
+        }
+
+        buffer, err := source.read(entryId)
+        if err != nil {
+            return err
+        }
+
+        if err := destination.write(entryId, buffer); err != nil {
+            return err
+        }
+    }
+
+    return syncStore(destination.references)
+}
+
+// indexes returns the identifiers of every index which exists on disk.
+func (s *Storage) indexes() ([]uint8, error) {
+    var ids []uint8
+    for id := 0; id <= 0xFF; id++ {
+        if _, err := os.Stat(s.indexPath(uint8(id))); err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return nil, err
+        }
+        ids = append(ids, uint8(id))
+    }
+    return ids, nil
+}
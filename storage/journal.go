@@ -0,0 +1,102 @@
+package storage
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "path"
+    "github.com/hadyn/goscape/types"
+)
+
+const (
+    journalName         = "batch.journal"
+    journalSuffix       = ".tmp"
+    journalRecordLength = 1 + 4 + ReferenceLength
+)
+
+var (
+    CorruptJournalError = errors.New("corrupt batch journal")
+)
+
+// writeJournal writes the references of a batch to a journal. The journal is written
+// alongside and renamed into place once it has been synced, so that it is either complete
+// or missing.
+func writeJournal(name string, writes []stagedWrite, refs []Reference) error {
+    buffer := make([]byte, len(refs)*journalRecordLength)
+    for i, ref := range refs {
+        record := buffer[i*journalRecordLength:]
+        record[0] = writes[i].volume.id
+        types.BigEndian.PutUint32(record[1:], ref.id)
+        ref.Write(record[5:])
+    }
+
+    file, err := os.Create(name + journalSuffix)
+    if err != nil {
+        return err
+    }
+
+    if _, err := file.Write(buffer); err != nil {
+        file.Close()
+        return err
+    }
+
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+
+    if err := file.Close(); err != nil {
+        return err
+    }
+
+    return os.Rename(name+journalSuffix, name)
+}
+
+// replayJournal writes the references of a batch which was interrupted while committing
+// them, and removes the journal. A journal which was never renamed into place is discarded.
+// Must be called with the mutex held.
+func (s *Storage) replayJournal() error {
+    name := path.Join(s.root, journalName)
+    os.Remove(name + journalSuffix)
+
+    buffer, err := ioutil.ReadFile(name)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+
+    if len(buffer)%journalRecordLength != 0 {
+        return CorruptJournalError
+    }
+
+    var volumes []*Volume
+    for offset := 0; offset < len(buffer); offset += journalRecordLength {
+        record := buffer[offset:]
+
+        volume, err := s.open(record[0])
+        if err != nil {
+            return err
+        }
+
+        ref := Reference{
+            id:      types.BigEndian.Uint32(record[1:]),
+            length:  types.BigEndian.Uint24(record[5:]),
+            blockId: types.BigEndian.Uint24(record[8:]),
+        }
+
+        if err := volume.writeReference(ref); err != nil {
+            return err
+        }
+        volumes = append(volumes, volume)
+    }
+
+    for _, volume := range volumes {
+        if err := syncStore(volume.references); err != nil {
+            return err
+        }
+    }
+
+    return os.Remove(name)
+}
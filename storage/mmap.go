@@ -0,0 +1,81 @@
+package storage
+
+import (
+    "io"
+    "os"
+)
+
+// mappedFile is a read-only file which serves reads from a memory mapping of its contents.
+// Writes are passed through to the file, which fails as it is opened read-only.
+type mappedFile struct {
+    *os.File
+    data []byte
+}
+
+func openMapped(name string) (*mappedFile, error) {
+    file, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+
+    stat, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    var data []byte
+    if stat.Size() > 0 {
+        if data, err = mmap(file, int(stat.Size())); err != nil {
+            file.Close()
+            return nil, err
+        }
+    }
+
+    return &mappedFile{File: file, data: data}, nil
+}
+
+// ReadAt copies from the mapping with the same semantics as os.File.ReadAt.
+func (m *mappedFile) ReadAt(buffer []byte, offset int64) (int, error) {
+    if offset < 0 {
+        return m.File.ReadAt(buffer, offset)
+    }
+
+    if offset >= int64(len(m.data)) {
+        return 0, io.EOF
+    }
+
+    n := copy(buffer, m.data[offset:])
+    if n < len(buffer) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (m *mappedFile) Size() (int64, error) {
+    return int64(len(m.data)), nil
+}
+
+// slice returns a view of the mapping without copying, along with the number of bytes
+// which were within the mapping. The view must not be modified. If the view would run past
+// the end of the mapping, a copy is returned instead with the bytes past the end zeroed and
+// the error from reading them.
+func (m *mappedFile) slice(offset int64, length int) ([]byte, int, error) {
+    if offset < 0 || offset+int64(length) > int64(len(m.data)) {
+        buffer := make([]byte, length)
+        n, err := m.ReadAt(buffer, offset)
+        return buffer, n, err
+    }
+    return m.data[offset : offset+int64(length)], length, nil
+}
+
+func (m *mappedFile) Close() error {
+    if m.data != nil {
+        if err := munmap(m.data); err != nil {
+            m.File.Close()
+            return err
+        }
+        m.data = nil
+    }
+    return m.File.Close()
+}
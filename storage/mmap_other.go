@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package storage
+
+import (
+    "errors"
+    "os"
+)
+
+var (
+    MappingUnsupportedError = errors.New("memory mapping is not supported on this platform")
+)
+
+func mmap(file *os.File, length int) ([]byte, error) {
+    return nil, MappingUnsupportedError
+}
+
+func munmap(data []byte) error {
+    return MappingUnsupportedError
+}
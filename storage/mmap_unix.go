@@ -0,0 +1,17 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package storage
+
+import (
+    "os"
+    "syscall"
+)
+
+func mmap(file *os.File, length int) ([]byte, error) {
+    return syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+    return syscall.Munmap(data)
+}
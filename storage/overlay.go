@@ -0,0 +1,431 @@
+package storage
+
+import (
+    "errors"
+    "os"
+    "path"
+    "path/filepath"
+    "github.com/hadyn/goscape/container"
+)
+
+var (
+    BakeDestinationError = errors.New("bake destination already holds a cache")
+)
+
+// Overlay is a copy-on-write storage. Entries are read from the overlay storage if they
+// have been written to it and from the base storage otherwise, while writes only ever
+// land in the overlay storage.
+type Overlay struct {
+    base    *Storage
+    overlay *Storage
+}
+
+// OverlayVolume is a volume of an overlay storage. The index file of the overlay volume is
+// only created once an entry is written to it.
+type OverlayVolume struct {
+    id      uint8
+    base    *Volume
+    overlay *Storage
+}
+
+func NewOverlay(base *Storage, overlay *Storage) *Overlay {
+    return &Overlay{
+        base:    base,
+        overlay: overlay,
+    }
+}
+
+// OpenOverlay opens the cache in the base directory read-only and an overlay for it in the
+// overlay directory, creating the overlay directory if it does not exist.
+func OpenOverlay(base string, overlay string) (*Overlay, error) {
+    baseStorage, err := OpenStorage(base, ReadOnly)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := os.MkdirAll(overlay, 0755); err != nil {
+        baseStorage.Close()
+        return nil, err
+    }
+
+    overlayStorage, err := NewStorage(overlay, baseStorage.provider, ReadWrite)
+    if err != nil {
+        baseStorage.Close()
+        return nil, err
+    }
+
+    return NewOverlay(baseStorage, overlayStorage), nil
+}
+
+// Open opens a volume of the overlay. The base storage does not need to contain the volume.
+func (o *Overlay) Open(id uint8) (*OverlayVolume, error) {
+    volume := &OverlayVolume{id: id, overlay: o.overlay}
+
+    exists, err := o.base.Exists(id)
+    if err != nil {
+        return nil, err
+    }
+
+    if exists {
+        if volume.base, err = o.base.Open(id); err != nil {
+            return nil, err
+        }
+    }
+
+    return volume, nil
+}
+
+// Volumes returns the identifiers of every volume in either the base or overlay storage.
+func (o *Overlay) Volumes() ([]uint8, error) {
+    base, err := o.base.Volumes()
+    if err != nil {
+        return nil, err
+    }
+
+    overlay, err := o.overlay.Volumes()
+    if err != nil {
+        return nil, err
+    }
+
+    var present [0x100]bool
+    for _, id := range append(base, overlay...) {
+        present[id] = true
+    }
+
+    var ids []uint8
+    for id, ok := range present {
+        if ok {
+            ids = append(ids, uint8(id))
+        }
+    }
+    return ids, nil
+}
+
+// Bake writes every entry of the overlay into a new cache in the given directory, using the
+// layout of the base storage. Fails with BakeDestinationError if the directory already
+// holds a cache or is the base or overlay directory.
+//
+// The reference table of each volume with overlaid groups has the digests and versions of
+// those groups updated and its revision bumped, unless the reference table was overlaid as
+// well. Groups which the reference table does not describe are not added to it, and the
+// checksum table is copied as is, so it should be rebuilt once the overlay has been baked.
+func (o *Overlay) Bake(root string) error {
+    if err := o.checkDestination(root); err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(root, 0755); err != nil {
+        return err
+    }
+
+    baked, err := NewStorage(root, o.base.provider, ReadWrite)
+    if err != nil {
+        return err
+    }
+    defer baked.Close()
+
+    ids, err := o.Volumes()
+    if err != nil {
+        return err
+    }
+
+    changed := make(map[uint8][]uint32)
+    for _, id := range ids {
+        volume, err := o.Open(id)
+        if err != nil {
+            return err
+        }
+
+        destination, err := baked.Open(id)
+        if err != nil {
+            return err
+        }
+
+        count, err := volume.Count()
+        if err != nil {
+            return err
+        }
+
+        for entryId := uint32(0); entryId < count; entryId++ {
+            exists, err := volume.exists(entryId)
+            if err != nil {
+                return err
+            }
+
+            if !exists {
+                continue
+            }
+
+            buffer, err := volume.Read(entryId)
+            if err != nil {
+                return err
+            }
+
+            if err := destination.Write(entryId, buffer); err != nil {
+                return err
+            }
+
+            if id == ReferenceTableVolume {
+                continue
+            }
+
+            overlaid, err := volume.overlaid(entryId)
+            if err != nil {
+                return err
+            }
+
+            if overlaid {
+                changed[id] = append(changed[id], entryId)
+            }
+        }
+    }
+
+    tables, err := o.Open(ReferenceTableVolume)
+    if err != nil {
+        return err
+    }
+
+    for id, groups := range changed {
+        overlaid, err := tables.overlaid(uint32(id))
+        if err != nil {
+            return err
+        }
+
+        if overlaid {
+            continue
+        }
+
+        if err := updateReferenceTable(baked, id, groups); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// checkDestination fails if baking into a directory would write into an existing cache,
+// including the base and overlay themselves.
+func (o *Overlay) checkDestination(root string) error {
+    if _, err := os.Stat(path.Join(root, o.base.provider.blocks())); err == nil {
+        return BakeDestinationError
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+
+    destination, err := resolve(root)
+    if err != nil {
+        return err
+    }
+
+    for _, storage := range []*Storage{o.base, o.overlay} {
+        dir, err := resolve(storage.root)
+        if err != nil {
+            return err
+        }
+
+        if dir == destination {
+            return BakeDestinationError
+        }
+    }
+
+    return nil
+}
+
+// resolve returns the absolute path of a directory with any symbolic links followed. The
+// directory does not need to exist.
+func resolve(dir string) (string, error) {
+    abs, err := filepath.Abs(dir)
+    if err != nil {
+        return "", err
+    }
+
+    resolved, err := filepath.EvalSymlinks(abs)
+    if os.IsNotExist(err) {
+        return abs, nil
+    }
+    return resolved, err
+}
+
+// updateReferenceTable updates the digests and versions of groups in the reference table of
+// a volume and bumps its revision. Does nothing if the volume has no reference table.
+func updateReferenceTable(s *Storage, id uint8, groups []uint32) error {
+    if exists, err := s.Exists(ReferenceTableVolume); !exists || err != nil {
+        return err
+    }
+
+    tables, err := s.Open(ReferenceTableVolume)
+    if err != nil {
+        return err
+    }
+
+    if exists, err := tables.Exists(uint32(id)); !exists || err != nil {
+        return err
+    }
+
+    buffer, err := tables.Read(uint32(id))
+    if err != nil {
+        return err
+    }
+
+    unpacked, err := container.Unpack(buffer)
+    if err != nil {
+        return err
+    }
+
+    table, err := DecodeReferenceTable(unpacked)
+    if err != nil {
+        return err
+    }
+
+    volume, err := s.Open(id)
+    if err != nil {
+        return err
+    }
+
+    for _, groupId := range groups {
+        group := table.Group(groupId)
+        if group == nil {
+            continue
+        }
+
+        entry, err := volume.Read(groupId)
+        if err != nil {
+            return err
+        }
+
+        digest, err := DigestEntry(entry)
+        if err != nil {
+            return err
+        }
+
+        version, versioned, err := container.Version(entry)
+        if err != nil {
+            return err
+        }
+
+        group.Crc = digest.Crc
+        if table.Flags&FlagWhirlpool != 0 {
+            group.Whirlpool = digest.Whirlpool
+        }
+
+        if versioned {
+            group.Version = uint32(version)
+        }
+    }
+
+    table.Revision++
+    return s.WriteReferenceTable(id, table, container.Compression(buffer[0]))
+}
+
+// Close closes both the base and overlay storage.
+func (o *Overlay) Close() error {
+    err := o.overlay.Close()
+    if baseErr := o.base.Close(); err == nil {
+        err = baseErr
+    }
+    return err
+}
+
+// Read reads an entry from the overlay if it has been written there, otherwise from the base.
+func (v *OverlayVolume) Read(id uint32) ([]byte, error) {
+    volumes, err := v.volumes()
+    if err != nil {
+        return nil, err
+    }
+
+    for _, volume := range volumes {
+        exists, err := volume.Exists(id)
+        if err != nil {
+            return nil, err
+        }
+
+        if exists {
+            return volume.Read(id)
+        }
+    }
+    return nil, EntryNotFoundError
+}
+
+// Write writes an entry to the overlay, creating the index file of the overlay volume if
+// nothing has been written to it yet.
+func (v *OverlayVolume) Write(id uint32, buffer []byte) error {
+    overlay, err := v.overlay.Open(v.id)
+    if err != nil {
+        return err
+    }
+    return overlay.Write(id, buffer)
+}
+
+// Count returns the number of references in the larger of the base and overlay volume.
+func (v *OverlayVolume) Count() (uint32, error) {
+    volumes, err := v.volumes()
+    if err != nil {
+        return 0, err
+    }
+
+    count := uint32(0)
+    for _, volume := range volumes {
+        n, err := volume.Count()
+        if err != nil {
+            return 0, err
+        }
+
+        if n > count {
+            count = n
+        }
+    }
+    return count, nil
+}
+
+func (v *OverlayVolume) exists(id uint32) (bool, error) {
+    volumes, err := v.volumes()
+    if err != nil {
+        return false, err
+    }
+
+    for _, volume := range volumes {
+        exists, err := volume.Exists(id)
+        if err != nil || exists {
+            return exists, err
+        }
+    }
+    return false, nil
+}
+
+// overlaid returns whether an entry has been written to the overlay.
+func (v *OverlayVolume) overlaid(id uint32) (bool, error) {
+    exists, err := v.overlay.Exists(v.id)
+    if err != nil || !exists {
+        return false, err
+    }
+
+    overlay, err := v.overlay.Open(v.id)
+    if err != nil {
+        return false, err
+    }
+    return overlay.Exists(id)
+}
+
+// volumes returns the overlay volume followed by the base volume, leaving out the overlay
+// volume if nothing has been written to it and the base volume if the base does not have it.
+func (v *OverlayVolume) volumes() ([]*Volume, error) {
+    var volumes []*Volume
+
+    exists, err := v.overlay.Exists(v.id)
+    if err != nil {
+        return nil, err
+    }
+
+    if exists {
+        overlay, err := v.overlay.Open(v.id)
+        if err != nil {
+            return nil, err
+        }
+        volumes = append(volumes, overlay)
+    }
+
+    if v.base != nil {
+        volumes = append(volumes, v.base)
+    }
+    return volumes, nil
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+    "testing"
+    "io/ioutil"
+    "os"
+    "path"
+    "bytes"
+    "github.com/hadyn/goscape/container"
+)
+
+func TestOverlay(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    if err := os.Mkdir(path.Join(dir, "base"), 0755); err != nil {
+        t.Fatal("failed to create the directory", err)
+    }
+
+    base, err := NewStorage(path.Join(dir, "base"), Dat2Provider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := base.Open(2)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    for id, contents := range []string{"zero", "one"} {
+        if err := volume.Write(uint32(id), []byte(contents)); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    base.Close()
+
+    overlay, err := OpenOverlay(path.Join(dir, "base"), path.Join(dir, "overlay"))
+    if err != nil {
+        t.Fatal("failed to open the overlay", err)
+    }
+
+    for _, id := range []uint8{2, 3} {
+        volume, err := overlay.Open(id)
+        if err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+
+        if err := volume.Write(1, []byte("modified")); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    check := func(volume interface{ Read(uint32) ([]byte, error) }, id uint32, expected string) {
+        entry, err := volume.Read(id)
+        if err != nil {
+            t.Fatal("failed to read the entry", err)
+        }
+
+        if !bytes.Equal(entry, []byte(expected)) {
+            t.Errorf("contents mismatch (expected: %s, actual: %s)", expected, entry)
+        }
+    }
+
+    overlaid, err := overlay.Open(2)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    check(overlaid, 0, "zero")
+    check(overlaid, 1, "modified")
+
+    // Reading a volume which has not been written to does not create its index file.
+    unwritten, err := overlay.Open(4)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if _, err := unwritten.Read(0); err != EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+
+    if exists, err := overlay.overlay.Exists(4); err != nil || exists {
+        t.Errorf("expected the overlay index not to be created (exists: %t, err: %v)", exists, err)
+    }
+
+    if err := overlay.Bake(path.Join(dir, "baked")); err != nil {
+        t.Fatal("failed to bake the overlay", err)
+    }
+
+    // Baking into the base, the overlay or an existing cache is refused.
+    for _, name := range []string{"base", "overlay", "baked", "base/../overlay"} {
+        if err := overlay.Bake(path.Join(dir, name)); err != BakeDestinationError {
+            t.Errorf("expected bake destination error (destination: %s), got: %v", name, err)
+        }
+    }
+
+    overlay.Close()
+
+    // The base cache must be left untouched.
+    base, err = OpenStorage(path.Join(dir, "base"), ReadOnly)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer base.Close()
+
+    if volume, err = base.Open(2); err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    check(volume, 1, "one")
+
+    baked, err := OpenStorage(path.Join(dir, "baked"), ReadOnly)
+    if err != nil {
+        t.Fatal("failed to open the baked storage", err)
+    }
+
+    defer baked.Close()
+
+    for id, expected := range map[uint8][]string{2: {"zero", "modified"}, 3: {"", "modified"}} {
+        volume, err := baked.Open(id)
+        if err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+
+        for entryId, contents := range expected {
+            if contents != "" {
+                check(volume, uint32(entryId), contents)
+            }
+        }
+    }
+}
+
+func TestOverlayBakeReferenceTable(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    if err := os.Mkdir(path.Join(dir, "base"), 0755); err != nil {
+        t.Fatal("failed to create the directory", err)
+    }
+
+    base, err := NewStorage(path.Join(dir, "base"), Dat2Provider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    table := &ReferenceTable{
+        Format:   RevisionedFormat,
+        Revision: 1,
+        Flags:    FlagWhirlpool,
+        Groups:   []*GroupReference{{Id: 0, Crc: 1, Version: 1}, {Id: 1, Crc: 2, Version: 1}},
+    }
+
+    if err := base.WriteReferenceTable(2, table, container.Gzip); err != nil {
+        t.Fatal("failed to write the reference table", err)
+    }
+
+    base.Close()
+
+    overlay, err := OpenOverlay(path.Join(dir, "base"), path.Join(dir, "overlay"))
+    if err != nil {
+        t.Fatal("failed to open the overlay", err)
+    }
+
+    volume, err := overlay.Open(2)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    c := &container.Container{Compression: container.None, Bytes: []byte("modified"), Version: 7, Versioned: true}
+    entry, err := c.Encode(container.NullKey)
+    if err != nil {
+        t.Fatal("failed to encode the container", err)
+    }
+
+    if err := volume.Write(1, entry); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    err = overlay.Bake(path.Join(dir, "baked"))
+    overlay.Close()
+
+    if err != nil {
+        t.Fatal("failed to bake the overlay", err)
+    }
+
+    baked, err := OpenStorage(path.Join(dir, "baked"), ReadOnly)
+    if err != nil {
+        t.Fatal("failed to open the baked storage", err)
+    }
+
+    defer baked.Close()
+
+    updated, err := baked.ReadReferenceTable(2)
+    if err != nil {
+        t.Fatal("failed to read the reference table", err)
+    }
+
+    digest, err := DigestEntry(entry)
+    if err != nil {
+        t.Fatal("failed to digest the entry", err)
+    }
+
+    if updated.Revision != 2 {
+        t.Errorf("revision mismatch (expected: 2, actual: %d)", updated.Revision)
+    }
+
+    if group := updated.Group(0); group.Crc != 1 || group.Version != 1 {
+        t.Errorf("expected group 0 to be unchanged: %+v", group)
+    }
+
+    if group := updated.Group(1); group.Crc != digest.Crc || group.Whirlpool != digest.Whirlpool || group.Version != 7 {
+        t.Errorf("expected group 1 to be updated: %+v", group)
+    }
+}
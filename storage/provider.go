@@ -0,0 +1,69 @@
+package storage
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path"
+)
+
+var (
+    UnknownLayoutError = errors.New("unknown cache layout")
+)
+
+// Dat2Provider names the files of the dat2 cache layout, which stores every volume in
+// main_file_cache.dat2 with the references of each volume in main_file_cache.idxN.
+type Dat2Provider struct{}
+
+func (Dat2Provider) index(id uint8) string {
+    return fmt.Sprintf("main_file_cache.idx%d", id)
+}
+
+func (Dat2Provider) blocks() string {
+    return "main_file_cache.dat2"
+}
+
+func (Dat2Provider) storeId(id uint8) uint8 {
+    return id
+}
+
+// LegacyProvider names the files of the 317 cache layout, which stores every volume in
+// main_file_cache.dat with the references of each volume in main_file_cache.idx0 to idx4.
+// Blocks are tagged with the volume identifier plus one.
+type LegacyProvider struct{}
+
+func (LegacyProvider) index(id uint8) string {
+    return fmt.Sprintf("main_file_cache.idx%d", id)
+}
+
+func (LegacyProvider) blocks() string {
+    return "main_file_cache.dat"
+}
+
+func (LegacyProvider) storeId(id uint8) uint8 {
+    return id + 1
+}
+
+// DetectProvider inspects a directory and returns the provider for the cache layout it
+// contains, preferring the dat2 layout if both are present.
+func DetectProvider(root string) (NameProvider, error) {
+    for _, provider := range []NameProvider{Dat2Provider{}, LegacyProvider{}} {
+        if _, err := os.Stat(path.Join(root, provider.blocks())); err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return nil, err
+        }
+        return provider, nil
+    }
+    return nil, UnknownLayoutError
+}
+
+// OpenStorage opens the cache in a directory, detecting its layout.
+func OpenStorage(root string, mode Mode) (*Storage, error) {
+    provider, err := DetectProvider(root)
+    if err != nil {
+        return nil, err
+    }
+    return NewStorage(root, provider, mode)
+}
@@ -9,7 +9,7 @@ const (
 )
 
 type Reference struct {
-    id      uint16
+    id      uint32
     length  uint32
     blockId uint32
 }
@@ -0,0 +1,428 @@
+package storage
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/names"
+    "github.com/hadyn/goscape/types"
+)
+
+const (
+    ReferenceTableVolume        = 255
+    WhirlpoolLength             = 64
+    FlagNamed             uint8 = 0x1
+    FlagWhirlpool         uint8 = 0x2
+    MinimumFormat               = 5
+    RevisionedFormat            = 6
+    SmartFormat                 = 7
+    minimumGroupLength          = 12
+    minimumChildLength          = 2
+
+    // supportedFlags are the flags which are decoded. Newer tables may also hold the sizes
+    // or the uncompressed CRCs of their groups, which are not supported.
+    supportedFlags = FlagNamed | FlagWhirlpool
+)
+
+var (
+    UnsupportedFormatError = errors.New("unsupported reference table format")
+    TruncatedTableError    = errors.New("truncated reference table")
+)
+
+// ReferenceTable describes the groups and child files stored within a volume. The tables
+// themselves are stored as entries within the reference table volume.
+type ReferenceTable struct {
+    Format   uint8
+    Revision uint32
+    Flags    uint8
+    Groups   []*GroupReference
+}
+
+type GroupReference struct {
+    Id        uint32
+    NameHash  uint32
+    Crc       uint32
+    Whirlpool [WhirlpoolLength]byte
+    Version   uint32
+    Children  []*ChildReference
+}
+
+type ChildReference struct {
+    Id       uint32
+    NameHash uint32
+}
+
+// ReadReferenceTable reads and decodes the reference table for a volume.
+func (s *Storage) ReadReferenceTable(id uint8) (*ReferenceTable, error) {
+    volume, err := s.Open(ReferenceTableVolume)
+    if err != nil {
+        return nil, err
+    }
+
+    buffer, err := volume.Read(uint32(id))
+    if err != nil {
+        return nil, err
+    }
+
+    unpacked, err := container.Unpack(buffer)
+    if err != nil {
+        return nil, err
+    }
+
+    return DecodeReferenceTable(unpacked)
+}
+
+// WriteReferenceTable encodes, packs and writes the reference table for a volume.
+func (s *Storage) WriteReferenceTable(id uint8, table *ReferenceTable, compression container.Compression) error {
+    encoded, err := table.Encode()
+    if err != nil {
+        return err
+    }
+
+    packed, err := container.Pack(encoded, compression)
+    if err != nil {
+        return err
+    }
+
+    volume, err := s.Open(ReferenceTableVolume)
+    if err != nil {
+        return err
+    }
+
+    return volume.Write(uint32(id), packed)
+}
+
+// DecodeReferenceTable decodes an unpacked reference table.
+func DecodeReferenceTable(buffer []byte) (*ReferenceTable, error) {
+    r := &tableReader{buffer: buffer}
+
+    table := &ReferenceTable{}
+    table.Format = r.byte()
+    if r.err == nil && (table.Format < MinimumFormat || table.Format > SmartFormat) {
+        return nil, UnsupportedFormatError
+    }
+
+    if table.Format >= RevisionedFormat {
+        table.Revision = r.uint32()
+    }
+
+    table.Flags = r.byte()
+    if r.err == nil && table.Flags&^supportedFlags != 0 {
+        return nil, UnsupportedFormatError
+    }
+
+    // Every group takes at least an identifier delta, a CRC, a version and a child count.
+    count := r.count(table.Format)
+    if !r.fits(count, minimumGroupLength) {
+        return nil, r.err
+    }
+
+    table.Groups = make([]*GroupReference, count)
+
+    // Group identifiers are delta encoded.
+    id := uint32(0)
+    for i := range table.Groups {
+        id += r.count(table.Format)
+        table.Groups[i] = &GroupReference{Id: id}
+    }
+
+    if table.Flags&FlagNamed != 0 {
+        for _, group := range table.Groups {
+            group.NameHash = r.uint32()
+        }
+    }
+
+    for _, group := range table.Groups {
+        group.Crc = r.uint32()
+    }
+
+    if table.Flags&FlagWhirlpool != 0 {
+        for _, group := range table.Groups {
+            copy(group.Whirlpool[:], r.bytes(WhirlpoolLength))
+        }
+    }
+
+    for _, group := range table.Groups {
+        group.Version = r.uint32()
+    }
+
+    // Every child takes at least an identifier delta, which must fit in what remains of
+    // the table once every child count has been read.
+    children := uint64(0)
+    for _, group := range table.Groups {
+        count := r.count(table.Format)
+        children += uint64(count)
+        if !r.fits(count, minimumChildLength) {
+            return nil, r.err
+        }
+        group.Children = make([]*ChildReference, count)
+    }
+
+    if children*minimumChildLength > uint64(len(buffer)-r.offset) {
+        return nil, TruncatedTableError
+    }
+
+    // Child identifiers are delta encoded per group.
+    for _, group := range table.Groups {
+        id := uint32(0)
+        for i := range group.Children {
+            id += r.count(table.Format)
+            group.Children[i] = &ChildReference{Id: id}
+        }
+    }
+
+    if table.Flags&FlagNamed != 0 {
+        for _, group := range table.Groups {
+            for _, child := range group.Children {
+                child.NameHash = r.uint32()
+            }
+        }
+    }
+
+    if r.err != nil {
+        return nil, r.err
+    }
+
+    return table, nil
+}
+
+// Encode encodes the reference table. Groups and their children must be sorted by
+// ascending identifier.
+func (t *ReferenceTable) Encode() ([]byte, error) {
+    if t.Format < MinimumFormat || t.Format > SmartFormat || t.Flags&^supportedFlags != 0 {
+        return nil, UnsupportedFormatError
+    }
+
+    w := &tableWriter{}
+    w.byte(t.Format)
+
+    if t.Format >= RevisionedFormat {
+        w.uint32(t.Revision)
+    }
+
+    w.byte(t.Flags)
+    if err := w.count(t.Format, uint32(len(t.Groups))); err != nil {
+        return nil, err
+    }
+
+    last := uint32(0)
+    for i, group := range t.Groups {
+        if i > 0 && group.Id <= last {
+            return nil, errors.New(fmt.Sprintf("group %d is out of order", group.Id))
+        }
+
+        if err := w.count(t.Format, group.Id-last); err != nil {
+            return nil, err
+        }
+        last = group.Id
+    }
+
+    if t.Flags&FlagNamed != 0 {
+        for _, group := range t.Groups {
+            w.uint32(group.NameHash)
+        }
+    }
+
+    for _, group := range t.Groups {
+        w.uint32(group.Crc)
+    }
+
+    if t.Flags&FlagWhirlpool != 0 {
+        for _, group := range t.Groups {
+            w.buffer.Write(group.Whirlpool[:])
+        }
+    }
+
+    for _, group := range t.Groups {
+        w.uint32(group.Version)
+    }
+
+    for _, group := range t.Groups {
+        if err := w.count(t.Format, uint32(len(group.Children))); err != nil {
+            return nil, err
+        }
+    }
+
+    for _, group := range t.Groups {
+        last := uint32(0)
+        for i, child := range group.Children {
+            if i > 0 && child.Id <= last {
+                return nil, errors.New(fmt.Sprintf("child %d of group %d is out of order", child.Id, group.Id))
+            }
+
+            if err := w.count(t.Format, child.Id-last); err != nil {
+                return nil, err
+            }
+            last = child.Id
+        }
+    }
+
+    if t.Flags&FlagNamed != 0 {
+        for _, group := range t.Groups {
+            for _, child := range group.Children {
+                w.uint32(child.NameHash)
+            }
+        }
+    }
+
+    return w.buffer.Bytes(), nil
+}
+
+// Group returns the group with the given identifier or nil if it does not exist.
+func (t *ReferenceTable) Group(id uint32) *GroupReference {
+    for _, group := range t.Groups {
+        if group.Id == id {
+            return group
+        }
+    }
+    return nil
+}
+
+// GroupByName returns the group with the given name or nil if it does not exist or the
+// table does not name its groups.
+func (t *ReferenceTable) GroupByName(name string) *GroupReference {
+    if t.Flags&FlagNamed == 0 {
+        return nil
+    }
+
+    hash := names.Hash(name)
+    for _, group := range t.Groups {
+        if group.NameHash == hash {
+            return group
+        }
+    }
+    return nil
+}
+
+// Child returns the child with the given identifier or nil if it does not exist.
+func (g *GroupReference) Child(id uint32) *ChildReference {
+    for _, child := range g.Children {
+        if child.Id == id {
+            return child
+        }
+    }
+    return nil
+}
+
+// ChildByName returns the child of a group with the given name or nil if it does not exist
+// or the table does not name its children.
+func (t *ReferenceTable) ChildByName(group *GroupReference, name string) *ChildReference {
+    if t.Flags&FlagNamed == 0 {
+        return nil
+    }
+
+    hash := names.Hash(name)
+    for _, child := range group.Children {
+        if child.NameHash == hash {
+            return child
+        }
+    }
+    return nil
+}
+
+// tableReader reads values from a reference table, recording the first error encountered.
+type tableReader struct {
+    buffer []byte
+    offset int
+    err    error
+}
+
+func (r *tableReader) bytes(n int) []byte {
+    if r.err != nil {
+        return nil
+    }
+
+    if r.offset+n > len(r.buffer) {
+        r.err = TruncatedTableError
+        return nil
+    }
+
+    b := r.buffer[r.offset : r.offset+n]
+    r.offset += n
+    return b
+}
+
+func (r *tableReader) byte() uint8 {
+    if b := r.bytes(1); b != nil {
+        return b[0]
+    }
+    return 0
+}
+
+func (r *tableReader) uint16() uint16 {
+    if b := r.bytes(2); b != nil {
+        return types.BigEndian.Uint16(b)
+    }
+    return 0
+}
+
+func (r *tableReader) uint32() uint32 {
+    if b := r.bytes(4); b != nil {
+        return types.BigEndian.Uint32(b)
+    }
+    return 0
+}
+
+// fits returns whether count values of at least the given length could fit in the rest
+// of the table, recording an error if not.
+func (r *tableReader) fits(count uint32, length int) bool {
+    if r.err == nil && uint64(count)*uint64(length) > uint64(len(r.buffer)-r.offset) {
+        r.err = TruncatedTableError
+    }
+    return r.err == nil
+}
+
+// count reads a count or identifier delta, which is a big smart in the smart format
+// and an unsigned short otherwise.
+func (r *tableReader) count(format uint8) uint32 {
+    if format < SmartFormat {
+        return uint32(r.uint16())
+    }
+
+    if r.err == nil && r.offset < len(r.buffer) && r.buffer[r.offset]&0x80 != 0 {
+        return r.uint32() & 0x7FFFFFFF
+    }
+    return uint32(r.uint16())
+}
+
+type tableWriter struct {
+    buffer bytes.Buffer
+}
+
+func (w *tableWriter) byte(v uint8) {
+    w.buffer.WriteByte(v)
+}
+
+func (w *tableWriter) uint16(v uint16) {
+    var b [2]byte
+    types.BigEndian.PutUint16(b[:], v)
+    w.buffer.Write(b[:])
+}
+
+func (w *tableWriter) uint32(v uint32) {
+    var b [4]byte
+    types.BigEndian.PutUint32(b[:], v)
+    w.buffer.Write(b[:])
+}
+
+func (w *tableWriter) count(format uint8, v uint32) error {
+    if format < SmartFormat {
+        if v > 0xFFFF {
+            return errors.New(fmt.Sprintf("value %d exceeds the maximum for format %d", v, format))
+        }
+        w.uint16(uint16(v))
+        return nil
+    }
+
+    if v > 0x7FFFFFFF {
+        return errors.New(fmt.Sprintf("value %d exceeds the maximum big smart", v))
+    }
+
+    if v >= 0x8000 {
+        w.uint32(v | 0x80000000)
+    } else {
+        w.uint16(uint16(v))
+    }
+    return nil
+}
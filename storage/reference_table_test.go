@@ -0,0 +1,187 @@
+package storage
+
+import (
+    "testing"
+    "bytes"
+    "github.com/hadyn/goscape/names"
+    "github.com/hadyn/goscape/types"
+)
+
+func TestReferenceTableDecode(t *testing.T) {
+    buffer := []byte{
+        6,          // Format
+        0, 0, 0, 9, // Revision
+        FlagNamed,  // Flags
+        0, 2,       // Group count
+        0, 1, 0, 3, // Group identifiers (1, 4)
+        0, 0, 0, 10, 0, 0, 0, 11, // Group name hashes
+        0, 0, 0, 20, 0, 0, 0, 21, // Group crcs
+        0, 0, 0, 30, 0, 0, 0, 31, // Group versions
+        0, 1, 0, 2, // Child counts
+        0, 0,       // Group 1 child identifiers (0)
+        0, 2, 0, 5, // Group 4 child identifiers (2, 7)
+        0, 0, 0, 40, 0, 0, 0, 41, 0, 0, 0, 42, // Child name hashes
+    }
+
+    table, err := DecodeReferenceTable(buffer)
+    if err != nil {
+        t.Fatalf("failed to decode the table: %s", err)
+    }
+
+    if table.Format != 6 || table.Revision != 9 || table.Flags != FlagNamed {
+        t.Errorf("header mismatch (format: %d, revision: %d, flags: %d)", table.Format, table.Revision, table.Flags)
+    }
+
+    if len(table.Groups) != 2 {
+        t.Fatalf("group count mismatch (expected: %d, actual: %d)", 2, len(table.Groups))
+    }
+
+    group := table.Group(4)
+    if group == nil {
+        t.Fatal("group 4 is missing")
+    }
+
+    if group.NameHash != 11 || group.Crc != 21 || group.Version != 31 {
+        t.Errorf("group mismatch (name: %d, crc: %d, version: %d)", group.NameHash, group.Crc, group.Version)
+    }
+
+    if len(group.Children) != 2 || group.Children[0].Id != 2 || group.Children[1].Id != 7 {
+        t.Fatal("child identifiers mismatch")
+    }
+
+    if group.Children[1].NameHash != 42 {
+        t.Errorf("child name mismatch (expected: %d, actual: %d)", 42, group.Children[1].NameHash)
+    }
+
+    encoded, err := table.Encode()
+    if err != nil {
+        t.Fatalf("failed to encode the table: %s", err)
+    }
+
+    if !bytes.Equal(encoded, buffer) {
+        t.Error("bytes mismatch")
+    }
+}
+
+func TestReferenceTableRoundTripSmart(t *testing.T) {
+    table := &ReferenceTable{
+        Format:   SmartFormat,
+        Revision: 1234,
+        Flags:    FlagNamed | FlagWhirlpool,
+        Groups: []*GroupReference{
+            {Id: 3, NameHash: 1, Crc: 2, Version: 3, Children: []*ChildReference{{Id: 0}}},
+            {Id: 70000, Crc: 5, Children: []*ChildReference{{Id: 1}, {Id: 40000, NameHash: 9}}},
+        },
+    }
+    table.Groups[1].Whirlpool[0] = 0xFF
+
+    encoded, err := table.Encode()
+    if err != nil {
+        t.Fatalf("failed to encode the table: %s", err)
+    }
+
+    // The group count is small enough to be encoded as a short.
+    if types.BigEndian.Uint16(encoded[6:]) != 2 {
+        t.Errorf("group count mismatch (expected: %d, actual: %d)", 2, types.BigEndian.Uint16(encoded[6:]))
+    }
+
+    decoded, err := DecodeReferenceTable(encoded)
+    if err != nil {
+        t.Fatalf("failed to decode the table: %s", err)
+    }
+
+    group := decoded.Group(70000)
+    if group == nil {
+        t.Fatal("group 70000 is missing")
+    }
+
+    if group.Whirlpool[0] != 0xFF || group.Crc != 5 {
+        t.Error("group mismatch")
+    }
+
+    if len(group.Children) != 2 || group.Children[1].Id != 40000 || group.Children[1].NameHash != 9 {
+        t.Error("child mismatch")
+    }
+
+    reencoded, err := decoded.Encode()
+    if err != nil {
+        t.Fatalf("failed to encode the table: %s", err)
+    }
+
+    if !bytes.Equal(encoded, reencoded) {
+        t.Error("bytes mismatch")
+    }
+}
+
+func TestReferenceTableTruncated(t *testing.T) {
+    if _, err := DecodeReferenceTable([]byte{6, 0, 0, 0, 1, 0, 0, 5}); err != TruncatedTableError {
+        t.Errorf("expected truncated table error, got: %v", err)
+    }
+}
+
+func TestReferenceTableUnsupportedFlags(t *testing.T) {
+    // The sizes flag adds fields which are not decoded.
+    if _, err := DecodeReferenceTable([]byte{6, 0, 0, 0, 1, 0x4, 0, 0}); err != UnsupportedFormatError {
+        t.Errorf("expected unsupported format error, got: %v", err)
+    }
+
+    table := &ReferenceTable{Format: RevisionedFormat, Flags: 0x8}
+    if _, err := table.Encode(); err != UnsupportedFormatError {
+        t.Errorf("expected unsupported format error, got: %v", err)
+    }
+}
+
+func TestReferenceTableLookupByName(t *testing.T) {
+    table := &ReferenceTable{
+        Format: RevisionedFormat,
+        Flags:  FlagNamed,
+        Groups: []*GroupReference{
+            {Id: 1, NameHash: names.Hash("huffman"), Children: []*ChildReference{
+                {Id: 0, NameHash: names.Hash("a")},
+                {Id: 3, NameHash: names.Hash("b")},
+            }},
+        },
+    }
+
+    group := table.GroupByName("huffman")
+    if group == nil || group.Id != 1 {
+        t.Fatal("group mismatch")
+    }
+
+    if child := table.ChildByName(group, "b"); child == nil || child.Id != 3 {
+        t.Error("child mismatch")
+    }
+
+    if table.ChildByName(group, "c") != nil {
+        t.Error("expected no child")
+    }
+
+    table.Flags = 0
+    if table.GroupByName("huffman") != nil {
+        t.Error("expected no group when the table is not named")
+    }
+
+    // Unnamed children all have a zero hash, which is also the hash of the empty name.
+    group.Children[0].NameHash = 0
+    if table.ChildByName(group, "") != nil {
+        t.Error("expected no child when the table is not named")
+    }
+}
+
+func TestReferenceTableCountTooLarge(t *testing.T) {
+    tests := [][]byte{
+        {SmartFormat, 0, 0, 0, 1, 0, 0xFF, 0xFF, 0xFF, 0xFF}, // Group count
+        {SmartFormat, 0, 0, 0, 1, 0, 0, 1, // Group count
+            0, 0, // Group identifiers
+            0, 0, 0, 0, // Group crcs
+            0, 0, 0, 0, // Group versions
+            0xFF, 0xFF, 0xFF, 0xFF, // Child counts
+        },
+    }
+
+    for i, buffer := range tests {
+        if _, err := DecodeReferenceTable(buffer); err != TruncatedTableError {
+            t.Errorf("expected truncated table error for table %d, got: %v", i, err)
+        }
+    }
+}
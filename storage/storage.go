@@ -4,38 +4,174 @@ import (
     "sync"
     "os"
     "path"
+    "errors"
+)
+
+type Mode uint8
+
+const (
+    ReadOnly  Mode = 0
+    ReadWrite Mode = 1
+    // Mapped is a read-only mode which memory maps the blocks file.
+    Mapped    Mode = 2
+)
+
+var (
+    ReadOnlyError = errors.New("storage is read only")
 )
 
 type Storage struct {
-    root     string
-    provider NameProvider
-    blocks   *os.File
-    mutex    *sync.Mutex
+    root      string
+    provider  NameProvider
+    mode      Mode
+    blocks    Store
+    volumes   map[uint8]*Volume
+    allocator *allocator
+    mutex     *sync.RWMutex
 }
 
 type NameProvider interface {
     index(id uint8) string
     blocks() string
+    storeId(id uint8) uint8
 }
 
-func NewStorage(root string, provider NameProvider) (*Storage, error) {
-    blocks, err := os.Open(path.Join(root, provider.blocks()))
+// NewStorage opens the blocks file of a cache. In read-write mode the blocks file is
+// created if it does not exist, and in mapped mode it is memory mapped.
+func NewStorage(root string, provider NameProvider, mode Mode) (*Storage, error) {
+    blocks, err := mode.openBlocks(path.Join(root, provider.blocks()))
     if err != nil {
         return nil, err
     }
 
-    return &Storage{
+    s := &Storage{
         root:     root,
         provider: provider,
+        mode:     mode,
         blocks:   blocks,
-        mutex:    &sync.Mutex{},
-    }, nil
+        volumes:  make(map[uint8]*Volume),
+        mutex:    &sync.RWMutex{},
+    }
+    s.allocator = newAllocator(s.freeBlocks)
+
+    // Complete any batch which was interrupted while its references were being written.
+    if mode == ReadWrite {
+        if err := s.replayJournal(); err != nil {
+            s.Close()
+            return nil, err
+        }
+    }
+
+    return s, nil
 }
 
+// Open opens a volume, returning the same volume if it has already been opened. In
+// read-write mode the index file is created if it does not exist.
 func (s *Storage) Open(id uint8) (*Volume, error) {
-    references, err := os.Open(path.Join(s.root, s.provider.index(id)))
+    s.mutex.RLock()
+    volume, ok := s.volumes[id]
+    s.mutex.RUnlock()
+
+    if ok {
+        return volume, nil
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    return s.open(id)
+}
+
+func (s *Storage) open(id uint8) (*Volume, error) {
+    if volume, ok := s.volumes[id]; ok {
+        return volume, nil
+    }
+
+    references, err := s.mode.open(s.indexPath(id))
+    if err != nil {
+        return nil, err
+    }
+
+    volume := s.volume(id, references, s.blocks)
+    s.volumes[id] = volume
+    return volume, nil
+}
+
+// Volumes returns the identifiers of every volume which has an index file on disk.
+func (s *Storage) Volumes() ([]uint8, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    return s.indexes()
+}
+
+// Exists returns whether a volume has been opened or has an index file on disk, without
+// creating its index file.
+func (s *Storage) Exists(id uint8) (bool, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    if _, ok := s.volumes[id]; ok {
+        return true, nil
+    }
+
+    if _, err := os.Stat(s.indexPath(id)); err != nil {
+        if os.IsNotExist(err) {
+            return false, nil
+        }
+        return false, err
+    }
+    return true, nil
+}
+
+// Close closes the blocks file and the index file of every opened volume.
+func (s *Storage) Close() error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var result error
+    for id, volume := range s.volumes {
+        if err := closeStore(volume.references); err != nil && result == nil {
+            result = err
+        }
+        delete(s.volumes, id)
+    }
+
+    if err := closeStore(s.blocks); err != nil && result == nil {
+        result = err
+    }
+
+    return result
+}
+
+func (s *Storage) indexPath(id uint8) string {
+    return path.Join(s.root, s.provider.index(id))
+}
+
+// volume creates a volume which tags its blocks with the store identifier of the layout.
+func (s *Storage) volume(id uint8, references Store, blocks Store) *Volume {
+    volume := NewVolume(id, references, blocks, s.mutex)
+    volume.storeId = s.provider.storeId(id)
+    volume.allocator = s.allocator
+    return volume
+}
+
+func (m Mode) openBlocks(name string) (Store, error) {
+    if m == Mapped {
+        return openMapped(name)
+    }
+    return m.open(name)
+}
+
+func (m Mode) open(name string) (Store, error) {
+    flag := os.O_RDONLY
+    if m == ReadWrite {
+        flag = os.O_RDWR | os.O_CREATE
+    }
+
+    file, err := os.OpenFile(name, flag, 0644)
     if err != nil {
         return nil, err
     }
-    return NewVolume(id, references, s.blocks, s.mutex), nil
+    return NewFileStore(file), nil
 }
@@ -6,22 +6,15 @@ import (
     "os"
     "bytes"
     "sync"
+    "fmt"
+    "io"
+    "path"
     "github.com/hadyn/goscape/types"
     "github.com/hadyn/goscape/internal"
 )
 
 func TestVolumeRead(t *testing.T) {
-    dir, err := ioutil.TempDir("", "tmp")
-    if err != nil {
-        t.Fatal("failed to open the directory", err)
-    }
-
-    defer os.RemoveAll(dir)
-
-    references, err := ioutil.TempFile(dir, "references")
-    if err != nil {
-        t.Fatal("failed to open the references file", err)
-    }
+    references := NewMemoryStore(nil)
 
     contents := internal.SequentialBytes(1000000)
     buffer := make([]byte, BlockLength)
@@ -30,14 +23,11 @@ func TestVolumeRead(t *testing.T) {
     reference := &Reference{0,uint32(len(contents)), blockId}
     reference.Write(buffer)
 
-    if _, err = references.Write(buffer[0:ReferenceLength]); err != nil {
+    if _, err := references.WriteAt(buffer[0:ReferenceLength], 0); err != nil {
         t.Fatal("failed to write the header", err)
     }
 
-    blocks, err := ioutil.TempFile(dir, "blocks")
-    if err != nil {
-        t.Fatal("failed to open the blocks file", err)
-    }
+    blocks := NewMemoryStore(nil)
 
     part := uint16(0)
     for i := 0; i < len(contents); i += BytesPerBlock {
@@ -49,11 +39,7 @@ func TestVolumeRead(t *testing.T) {
         block := &Block{blockId, 0, 0, part, blockId+1, contents[i:i+length] }
         block.Write(buffer)
 
-        if _, err = blocks.Seek(int64(blockId*BlockLength), 0); err != nil {
-            t.Fatal("failed to seek in blocks file", err)
-        }
-
-        if _, err = blocks.Write(buffer[0:BlockLength]); err != nil {
+        if _, err := blocks.WriteAt(buffer[0:BlockLength], int64(blockId)*BlockLength); err != nil {
             t.Fatal("failed to write block", err)
         }
 
@@ -61,7 +47,7 @@ func TestVolumeRead(t *testing.T) {
         part++
     }
 
-    volume := NewVolume(0, references, blocks, &sync.Mutex{})
+    volume := NewVolume(0, references, blocks, &sync.RWMutex{})
 
     entry, err := volume.Read(0)
     if err != nil {
@@ -74,40 +60,22 @@ func TestVolumeRead(t *testing.T) {
 }
 
 func TestVolumeWriteAppend(t *testing.T) {
-    dir, err := ioutil.TempDir("", "tmp")
-    if err != nil {
-        t.Fatal("failed to open the directory", err)
-    }
-
-    defer os.RemoveAll(dir)
-
-    references, err := ioutil.TempFile(dir, "references")
-    if err != nil {
-        t.Fatal("failed to open the references file", err)
-    }
-
-    blocks, err := ioutil.TempFile(dir, "blocks")
-    if err != nil {
-        t.Fatal("failed to open the blocks file", err)
-    }
+    references := NewMemoryStore(nil)
+    blocks := NewMemoryStore(nil)
 
     volumeId := uint8(0)
     entryId := uint16(0)
     contents := internal.SequentialBytes(1000000)
     length := uint32(len(contents))
 
-    volume := NewVolume(volumeId, references, blocks, &sync.Mutex{})
-    if err := volume.Write(entryId, contents); err != nil {
+    volume := NewVolume(volumeId, references, blocks, &sync.RWMutex{})
+    if err := volume.Write(uint32(entryId), contents); err != nil {
         t.Fatal("failed to write the entry")
     }
 
     buffer := make([]byte, BlockLength)
 
-    if _, err := references.Seek(int64(entryId*ReferenceLength), 0); err != nil {
-        t.Fatal("failed to seek to reference")
-    }
-
-    if _, err := references.Read(buffer[0:ReferenceLength]); err != nil {
+    if _, err := references.ReadAt(buffer[0:ReferenceLength], int64(entryId)*ReferenceLength); err != nil {
         t.Fatal("failed to read the reference bytes")
     }
 
@@ -128,11 +96,7 @@ func TestVolumeWriteAppend(t *testing.T) {
             t.Fatal("unexpected end of entry")
         }
 
-        if _, err := blocks.Seek(int64(blockId*BlockLength), 0); err != nil {
-            t.Fatal("failed to seek in blocks file")
-        }
-
-        if _, err := blocks.Read(buffer[:BlockLength]); err != nil {
+        if _, err := blocks.ReadAt(buffer[:BlockLength], int64(blockId)*BlockLength); err != nil {
             t.Fatal("failed to read the block bytes")
         }
 
@@ -166,4 +130,835 @@ func TestVolumeWriteAppend(t *testing.T) {
     if !bytes.Equal(compare, contents) {
         t.Error("bytes mismatch")
     }
-}
\ No newline at end of file
+}
+
+func TestVolumeRoundTripExtended(t *testing.T) {
+    blocks := NewMemoryStore(nil)
+
+    entryId := uint32(70000)
+    contents := internal.SequentialBytes(10000)
+
+    volume := NewVolume(0, NewMemoryStore(nil), blocks, &sync.RWMutex{})
+    if err := volume.Write(entryId, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    buffer := make([]byte, BlockLength)
+    if _, err := blocks.ReadAt(buffer, BlockLength); err != nil {
+        t.Fatal("failed to read the block bytes", err)
+    }
+
+    if types.BigEndian.Uint32(buffer[0:]) != entryId {
+        t.Errorf("entry identifier mismatch (expected: %d, actual: %d)", entryId, types.BigEndian.Uint32(buffer[0:]))
+    }
+
+    entry, err := volume.Read(entryId)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, contents) {
+        t.Error("contents mismatch")
+    }
+
+    size, err := blocks.Size()
+    if err != nil {
+        t.Fatal("failed to get the blocks size", err)
+    }
+
+    expected := int64(1+(len(contents)+BytesPerExtendedBlock-1)/BytesPerExtendedBlock) * BlockLength
+    if size != expected {
+        t.Errorf("blocks length mismatch (expected: %d, actual: %d)", expected, size)
+    }
+}
+
+type testProvider struct{}
+
+func (testProvider) index(id uint8) string {
+    return fmt.Sprintf("index%d", id)
+}
+
+func (testProvider) blocks() string {
+    return "blocks"
+}
+
+func (testProvider) storeId(id uint8) uint8 {
+    return id
+}
+
+func TestStorageCompact(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    small := internal.SequentialBytes(1000)
+    large := internal.SequentialBytes(5000)
+
+    for _, id := range []uint8{0, 2} {
+        volume, err := storage.Open(id)
+        if err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+
+        // Writing a larger entry over a smaller one orphans the original blocks.
+        for entryId, contents := range [][]byte{small, small, large} {
+            if err := volume.Write(uint32(entryId), contents); err != nil {
+                t.Fatal("failed to write the entry", err)
+            }
+        }
+
+        if err := volume.Write(1, large); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    reclaimed, err := storage.Compact()
+    if err != nil {
+        t.Fatal("failed to compact the storage", err)
+    }
+
+    // The blocks orphaned in volume 0 are reused by the writes to volume 2, so only those
+    // orphaned by the last write are left to reclaim.
+    if expected := int64(2 * BlockLength); reclaimed != expected {
+        t.Errorf("reclaimed mismatch (expected: %d, actual: %d)", expected, reclaimed)
+    }
+
+    for _, id := range []uint8{0, 2} {
+        volume, err := storage.Open(id)
+        if err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+
+        for entryId, contents := range [][]byte{small, large, large} {
+            entry, err := volume.Read(uint32(entryId))
+            if err != nil {
+                t.Fatal("failed to read the entry", err)
+            }
+
+            if !bytes.Equal(entry, contents) {
+                t.Errorf("contents mismatch (volume: %d, entry: %d)", id, entryId)
+            }
+        }
+    }
+}
+
+func TestDetectProvider(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    if _, err := DetectProvider(dir); err != UnknownLayoutError {
+        t.Errorf("expected unknown layout error, got: %v", err)
+    }
+
+    for _, expected := range []NameProvider{LegacyProvider{}, Dat2Provider{}} {
+        if err := ioutil.WriteFile(path.Join(dir, expected.blocks()), nil, 0644); err != nil {
+            t.Fatal("failed to create the blocks file", err)
+        }
+
+        provider, err := DetectProvider(dir)
+        if err != nil {
+            t.Fatal("failed to detect the provider", err)
+        }
+
+        if provider != expected {
+            t.Errorf("provider mismatch (expected: %T, actual: %T)", expected, provider)
+        }
+    }
+}
+
+func TestStorageOpenMode(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    provider := testProvider{}
+    if _, err := NewStorage(dir, provider, ReadOnly); !os.IsNotExist(err) {
+        t.Errorf("expected not exist error, got: %v", err)
+    }
+
+    storage, err := NewStorage(dir, provider, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := storage.Open(3)
+    if err != nil {
+        t.Fatal("failed to create the volume", err)
+    }
+
+    if err := volume.Write(0, []byte("Hello world!")); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    if err := storage.Close(); err != nil {
+        t.Fatal("failed to close the storage", err)
+    }
+
+    storage, err = NewStorage(dir, provider, ReadOnly)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    if _, err := storage.Open(4); !os.IsNotExist(err) {
+        t.Errorf("expected not exist error, got: %v", err)
+    }
+
+    if _, err := storage.Compact(); err != ReadOnlyError {
+        t.Errorf("expected read only error, got: %v", err)
+    }
+
+    volume, err = storage.Open(3)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    entry, err := volume.Read(0)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, []byte("Hello world!")) {
+        t.Error("contents mismatch")
+    }
+}
+
+func TestStorageVolumes(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    first, err := storage.Open(7)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    second, err := storage.Open(7)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if first != second {
+        t.Error("expected the same volume")
+    }
+
+    if _, err := storage.Open(ReferenceTableVolume); err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    ids, err := storage.Volumes()
+    if err != nil {
+        t.Fatal("failed to list the volumes", err)
+    }
+
+    if len(ids) != 2 || ids[0] != 7 || ids[1] != ReferenceTableVolume {
+        t.Errorf("volumes mismatch: %v", ids)
+    }
+}
+
+func benchmarkVolume(b *testing.B) (*Volume, func()) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        b.Fatal("failed to open the directory", err)
+    }
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        b.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        b.Fatal("failed to open the volume", err)
+    }
+
+    contents := internal.SequentialBytes(10000)
+    for id := uint32(0); id < 64; id++ {
+        if err := volume.Write(id, contents); err != nil {
+            b.Fatal("failed to write the entry", err)
+        }
+    }
+
+    return volume, func() {
+        storage.Close()
+        os.RemoveAll(dir)
+    }
+}
+
+func BenchmarkVolumeRead(b *testing.B) {
+    volume, cleanup := benchmarkVolume(b)
+    defer cleanup()
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if _, err := volume.Read(uint32(i % 64)); err != nil {
+            b.Fatal("failed to read the entry", err)
+        }
+    }
+}
+
+func BenchmarkVolumeReadParallel(b *testing.B) {
+    volume, cleanup := benchmarkVolume(b)
+    defer cleanup()
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for id := uint32(0); pb.Next(); id++ {
+            if _, err := volume.Read(id % 64); err != nil {
+                b.Fatal("failed to read the entry", err)
+            }
+        }
+    })
+}
+
+func TestStorageMapped(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    provider := testProvider{}
+    contents := internal.SequentialBytes(100000)
+
+    storage, err := NewStorage(dir, provider, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if err := volume.Write(0, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    storage.Close()
+
+    mapped, err := NewStorage(dir, provider, Mapped)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer mapped.Close()
+
+    if volume, err = mapped.Open(0); err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    entry, err := volume.Read(0)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, contents) {
+        t.Error("contents mismatch")
+    }
+
+    if _, err := volume.Read(1); err != EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+
+    if err := volume.Write(0, contents); err == nil {
+        t.Error("expected the write to fail")
+    }
+}
+
+func TestVolumeDelete(t *testing.T) {
+    blocks := NewMemoryStore(nil)
+    volume := NewVolume(0, NewMemoryStore(nil), blocks, &sync.RWMutex{})
+
+    contents := internal.SequentialBytes(2000)
+    for id := uint32(0); id < 3; id++ {
+        if err := volume.Write(id, contents); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    if count, err := volume.Count(); err != nil || count != 3 {
+        t.Errorf("count mismatch (expected: %d, actual: %d)", 3, count)
+    }
+
+    if length, err := volume.Length(1); err != nil || length != uint32(len(contents)) {
+        t.Errorf("length mismatch (expected: %d, actual: %d)", len(contents), length)
+    }
+
+    if err := volume.Delete(1, true); err != nil {
+        t.Fatal("failed to delete the entry", err)
+    }
+
+    if exists, err := volume.Exists(1); err != nil || exists {
+        t.Error("expected the entry to be deleted")
+    }
+
+    if _, err := volume.Length(1); err != EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+
+    if _, err := volume.Read(1); err != EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+
+    if err := volume.Delete(1, false); err != EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+
+    if exists, err := volume.Exists(5); err != nil || exists {
+        t.Error("expected the entry to not exist")
+    }
+
+    // The blocks of the deleted entry are zeroed while the others are intact.
+    zeroed := 0
+    data := blocks.Bytes()
+    for offset := BlockLength; offset < len(data); offset += BlockLength {
+        if bytes.Equal(data[offset:offset+BlockLength], make([]byte, BlockLength)) {
+            zeroed++
+        }
+    }
+
+    if zeroed != 4 {
+        t.Errorf("zeroed block count mismatch (expected: %d, actual: %d)", 4, zeroed)
+    }
+
+    for _, id := range []uint32{0, 2} {
+        entry, err := volume.Read(id)
+        if err != nil {
+            t.Fatal("failed to read the entry", err)
+        }
+
+        if !bytes.Equal(entry, contents) {
+            t.Error("contents mismatch")
+        }
+    }
+}
+
+func TestVolumeWatch(t *testing.T) {
+    volume := NewVolume(0, NewMemoryStore(nil), NewMemoryStore(nil), &sync.RWMutex{})
+
+    var changed []uint32
+    volume.Watch(func(id uint32) {
+        changed = append(changed, id)
+    })
+
+    if err := volume.Write(3, []byte("three")); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    writer, err := volume.OpenWriter(4)
+    if err != nil {
+        t.Fatal("failed to open the writer", err)
+    }
+
+    writer.Write([]byte("four"))
+    if err := writer.Close(); err != nil {
+        t.Fatal("failed to close the writer", err)
+    }
+
+    batch := NewBatch()
+    batch.Write(volume, 5, []byte("five"))
+    if err := batch.Commit(); err != nil {
+        t.Fatal("failed to commit the batch", err)
+    }
+
+    if err := volume.Delete(3, false); err != nil {
+        t.Fatal("failed to delete the entry", err)
+    }
+
+    expected := []uint32{3, 4, 5, 3}
+    if fmt.Sprint(changed) != fmt.Sprint(expected) {
+        t.Errorf("changes mismatch (expected: %v, actual: %v)", expected, changed)
+    }
+}
+
+func TestMemoryStore(t *testing.T) {
+    store := NewMemoryStore(nil)
+
+    if _, err := store.WriteAt([]byte{1, 2, 3, 4}, 0); err != nil {
+        t.Fatal("failed to write", err)
+    }
+
+    // Bytes left behind in the capacity by truncating are not read back after growing.
+    if err := store.Truncate(1); err != nil {
+        t.Fatal("failed to truncate", err)
+    }
+
+    if _, err := store.WriteAt([]byte{5}, 3); err != nil {
+        t.Fatal("failed to write", err)
+    }
+
+    if !bytes.Equal(store.Bytes(), []byte{1, 0, 0, 5}) {
+        t.Errorf("bytes mismatch: %v", store.Bytes())
+    }
+
+    buffer := make([]byte, 1)
+    if _, err := store.ReadAt(buffer, -1); err != NegativeOffsetError {
+        t.Errorf("expected negative offset error, got: %v", err)
+    }
+
+    if _, err := store.WriteAt(buffer, -1); err != NegativeOffsetError {
+        t.Errorf("expected negative offset error, got: %v", err)
+    }
+}
+
+func TestStorageShortFinalBlock(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    provider := testProvider{}
+    contents := internal.SequentialBytes(1000)
+
+    storage, err := NewStorage(dir, provider, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if err := volume.Write(0, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    storage.Close()
+
+    // Cut the last block short after its header and payload, as the client does.
+    blocks := path.Join(dir, provider.blocks())
+    size := int64(2*BlockLength + BlockHeaderLength + len(contents) - BytesPerBlock)
+    if err := os.Truncate(blocks, size); err != nil {
+        t.Fatal("failed to truncate the blocks", err)
+    }
+
+    for _, mode := range []Mode{ReadOnly, Mapped} {
+        storage, err := NewStorage(dir, provider, mode)
+        if err != nil {
+            t.Fatal("failed to open the storage", err)
+        }
+
+        volume, err := storage.Open(0)
+        if err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+
+        entry, err := volume.Read(0)
+        if err != nil {
+            t.Fatalf("failed to read the entry (mode: %d): %s", mode, err)
+        }
+
+        if !bytes.Equal(entry, contents) {
+            t.Errorf("contents mismatch (mode: %d)", mode)
+        }
+
+        corruptions, err := storage.Verify()
+        if err != nil || len(corruptions) != 0 {
+            t.Errorf("verify failed (mode: %d, error: %v): %v", mode, err, corruptions)
+        }
+
+        storage.Close()
+    }
+
+    // The block is corrupt if the file ends before the bytes the entry needs.
+    if err := os.Truncate(blocks, size-1); err != nil {
+        t.Fatal("failed to truncate the blocks", err)
+    }
+
+    storage, err = NewStorage(dir, provider, ReadOnly)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    if volume, err = storage.Open(0); err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    if _, err := volume.Read(0); err != io.ErrUnexpectedEOF {
+        t.Errorf("expected unexpected end of file error, got: %v", err)
+    }
+}
+
+func TestStorageCompactConcurrentReads(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    contents := internal.SequentialBytes(5000)
+    if err := volume.Write(0, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    var wg sync.WaitGroup
+    done := make(chan struct{})
+    errs := make(chan error, 4)
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-done:
+                    return
+                default:
+                }
+
+                entry, err := volume.Read(0)
+                if err == nil && !bytes.Equal(entry, contents) {
+                    err = fmt.Errorf("contents mismatch")
+                }
+
+                if err != nil {
+                    errs <- err
+                    return
+                }
+            }
+        }()
+    }
+
+    for i := 0; i < 20; i++ {
+        if _, err := storage.Compact(); err != nil {
+            t.Fatal("failed to compact the storage", err)
+        }
+    }
+
+    close(done)
+    wg.Wait()
+    close(errs)
+
+    for err := range errs {
+        t.Errorf("failed to read the entry during compaction: %s", err)
+    }
+}
+
+func TestStorageCompactRestoresOnFailure(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    provider := testProvider{}
+    storage, err := NewStorage(dir, provider, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    contents := internal.SequentialBytes(1000)
+    for i := 0; i < 2; i++ {
+        if err := volume.Write(0, contents); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    index := path.Join(dir, provider.index(0))
+    before, err := ioutil.ReadFile(index)
+    if err != nil {
+        t.Fatal("failed to read the index", err)
+    }
+
+    // The blocks file is swapped last and cannot be moved over a directory which is not
+    // empty, so the index which was already swapped must be restored.
+    backup := path.Join(dir, provider.blocks()+backupSuffix)
+    if err := os.MkdirAll(path.Join(backup, "full"), 0755); err != nil {
+        t.Fatal("failed to create the directory", err)
+    }
+
+    if _, err := storage.Compact(); err == nil {
+        t.Fatal("expected compacting to fail")
+    }
+
+    after, err := ioutil.ReadFile(index)
+    if err != nil {
+        t.Fatal("failed to read the index", err)
+    }
+
+    if !bytes.Equal(before, after) {
+        t.Error("index was not restored")
+    }
+
+    for _, name := range []string{provider.index(0), provider.blocks()} {
+        if _, err := os.Stat(path.Join(dir, name+compactSuffix)); !os.IsNotExist(err) {
+            t.Errorf("expected %s to be cleaned up", name+compactSuffix)
+        }
+    }
+
+    entry, err := volume.Read(0)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, contents) {
+        t.Error("contents mismatch")
+    }
+}
+
+func TestVolumeWriteFailureKeepsEntry(t *testing.T) {
+    blocks := &failingStore{NewMemoryStore(nil), 3}
+    volume := NewVolume(0, NewMemoryStore(nil), blocks, &sync.RWMutex{})
+
+    contents := internal.SequentialBytes(1000)
+    if err := volume.Write(0, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    // Writing fails part way through the new blocks, which must not touch the old ones.
+    if err := volume.Write(0, internal.SequentialBytes(1500)); err == nil {
+        t.Fatal("expected the write to fail")
+    }
+
+    entry, err := volume.Read(0)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, contents) {
+        t.Error("contents mismatch")
+    }
+}
+
+func TestStorageReusesFreeBlocks(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    contents := internal.SequentialBytes(1000)
+    for i := 0; i < 2; i++ {
+        if err := volume.Write(0, contents); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    storage.Close()
+
+    // The blocks orphaned before the storage was reopened are found and reused.
+    if storage, err = NewStorage(dir, testProvider{}, ReadWrite); err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    if volume, err = storage.Open(0); err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    size, err := storage.blocks.Size()
+    if err != nil {
+        t.Fatal("failed to get the size", err)
+    }
+
+    if err := volume.Write(1, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    if err := volume.Delete(0, false); err != nil {
+        t.Fatal("failed to delete the entry", err)
+    }
+
+    if err := volume.Write(2, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    if after, err := storage.blocks.Size(); err != nil || after != size {
+        t.Errorf("size mismatch (expected: %d, actual: %d)", size, after)
+    }
+
+    for _, id := range []uint32{1, 2} {
+        entry, err := volume.Read(id)
+        if err != nil {
+            t.Fatal("failed to read the entry", err)
+        }
+
+        if !bytes.Equal(entry, contents) {
+            t.Errorf("contents mismatch (entry: %d)", id)
+        }
+    }
+}
+
+func TestVolumeRepeatedWritesReuseBlocks(t *testing.T) {
+    blocks := NewMemoryStore(nil)
+    volume := NewVolume(0, NewMemoryStore(nil), blocks, &sync.RWMutex{})
+
+    // Each write takes two blocks, and the blocks of the previous write are reused by the
+    // one after, while the first block of the file is never used.
+    for i := 0; i < 10; i++ {
+        if err := volume.Write(0, internal.SequentialBytes(1000)); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    if size, _ := blocks.Size(); size != 5*BlockLength {
+        t.Errorf("blocks length mismatch (expected: %d, actual: %d)", 5*BlockLength, size)
+    }
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+    "io"
+    "os"
+    "sync"
+)
+
+// Store is the backing store of the references or blocks of a volume.
+type Store interface {
+    io.ReaderAt
+    io.WriterAt
+    Size() (int64, error)
+    Truncate(size int64) error
+}
+
+// FileStore is a store backed by a file.
+type FileStore struct {
+    *os.File
+}
+
+func NewFileStore(file *os.File) *FileStore {
+    return &FileStore{file}
+}
+
+func (f *FileStore) Size() (int64, error) {
+    stat, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+    return stat.Size(), nil
+}
+
+// MemoryStore is a store held entirely in memory. Reads past the end of the store fail
+// with io.EOF and writes past the end grow it, as they would for a file.
+type MemoryStore struct {
+    data  []byte
+    mutex sync.RWMutex
+}
+
+func NewMemoryStore(data []byte) *MemoryStore {
+    return &MemoryStore{data: data}
+}
+
+func (m *MemoryStore) ReadAt(buffer []byte, offset int64) (int, error) {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    if offset < 0 {
+        return 0, NegativeOffsetError
+    }
+
+    if offset >= int64(len(m.data)) {
+        return 0, io.EOF
+    }
+
+    n := copy(buffer, m.data[offset:])
+    if n < len(buffer) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (m *MemoryStore) WriteAt(buffer []byte, offset int64) (int, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if offset < 0 {
+        return 0, NegativeOffsetError
+    }
+
+    if end := offset + int64(len(buffer)); end > int64(len(m.data)) {
+        m.grow(end)
+    }
+    return copy(m.data[offset:], buffer), nil
+}
+
+func (m *MemoryStore) Size() (int64, error) {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    return int64(len(m.data)), nil
+}
+
+func (m *MemoryStore) Truncate(size int64) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if size < 0 {
+        return NegativeOffsetError
+    }
+
+    if size > int64(len(m.data)) {
+        m.grow(size)
+    } else {
+        m.data = m.data[:size]
+    }
+    return nil
+}
+
+// Bytes returns the contents of the store.
+func (m *MemoryStore) Bytes() []byte {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    return m.data
+}
+
+// grow extends the store to the given size with zeroes. The capacity grows geometrically
+// so that appending to the store does not copy its contents every time.
+func (m *MemoryStore) grow(size int64) {
+    length := len(m.data)
+    if size <= int64(cap(m.data)) {
+        m.data = m.data[:size]
+
+        // The capacity may hold bytes from before the store was truncated.
+        for i := length; i < len(m.data); i++ {
+            m.data[i] = 0
+        }
+        return
+    }
+
+    m.data = append(m.data, make([]byte, size-int64(length))...)
+}
+
+// closeStore closes a store if it holds any resources.
+func closeStore(store Store) error {
+    if closer, ok := store.(io.Closer); ok {
+        return closer.Close()
+    }
+    return nil
+}
+
+// syncStore commits the contents of a store to disk if it is backed by a file.
+func syncStore(store Store) error {
+    if syncer, ok := store.(interface{ Sync() error }); ok {
+        return syncer.Sync()
+    }
+    return nil
+}
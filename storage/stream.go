@@ -0,0 +1,303 @@
+package storage
+
+import (
+    "errors"
+    "io"
+)
+
+var (
+    NegativeOffsetError = errors.New("negative offset")
+    WriterClosedError   = errors.New("writer is closed")
+    StaleWriterError    = errors.New("storage was compacted while the writer was open")
+)
+
+// EntryReader reads an entry lazily, reading and validating each block as it is reached.
+type EntryReader struct {
+    volume   *Volume
+    ref      Reference
+    capacity uint32
+    offset   int64
+    blockIds []uint32
+    part     int
+    block    []byte
+}
+
+// EntryWriter writes an entry as it is streamed, writing each block to a block which no
+// entry owns. The reference is only updated once the writer is closed, so the previous
+// entry remains intact until then. A writer which is open while the storage is compacted
+// fails with StaleWriterError, as the blocks it wrote are not carried over.
+type EntryWriter struct {
+    volume   *Volume
+    blocks   Store
+    id       uint32
+    capacity uint32
+    first    uint32
+    blockId  uint32
+    part     uint16
+    length   uint32
+    buffer   []byte
+    pending  bool
+    closed   bool
+}
+
+// OpenReader opens a reader for an entry.
+func (v *Volume) OpenReader(id uint32) (*EntryReader, error) {
+    v.mutex.RLock()
+    defer v.mutex.RUnlock()
+
+    ref, err := v.reference(id)
+    if err != nil {
+        return nil, err
+    }
+
+    return &EntryReader{
+        volume:   v,
+        ref:      ref,
+        capacity: Capacity(id),
+        blockIds: []uint32{ref.blockId},
+        part:     -1,
+    }, nil
+}
+
+func (r *EntryReader) Read(buffer []byte) (int, error) {
+    length := int64(r.ref.length)
+    if r.offset >= length {
+        return 0, io.EOF
+    }
+
+    part := int(r.offset / int64(r.capacity))
+    if err := r.load(part); err != nil {
+        return 0, err
+    }
+
+    start := r.offset - int64(part)*int64(r.capacity)
+    end := int64(r.capacity)
+    if remaining := length - int64(part)*int64(r.capacity); remaining < end {
+        end = remaining
+    }
+
+    n := copy(buffer, r.block[start:end])
+    r.offset += int64(n)
+    return n, nil
+}
+
+func (r *EntryReader) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekStart:
+    case io.SeekCurrent:
+        offset += r.offset
+    case io.SeekEnd:
+        offset += int64(r.ref.length)
+    default:
+        return 0, errors.New("invalid whence")
+    }
+
+    if offset < 0 {
+        return 0, NegativeOffsetError
+    }
+
+    r.offset = offset
+    return offset, nil
+}
+
+// Len returns the length of the entry.
+func (r *EntryReader) Len() int64 {
+    return int64(r.ref.length)
+}
+
+// load reads the block holding the given part of the entry, following the chain from the
+// furthest block reached so far.
+func (r *EntryReader) load(part int) error {
+    if part == r.part {
+        return nil
+    }
+
+    r.volume.mutex.RLock()
+    defer r.volume.mutex.RUnlock()
+
+    for len(r.blockIds) <= part {
+        last := len(r.blockIds) - 1
+        block, err := r.read(last)
+        if err != nil {
+            return err
+        }
+        r.blockIds = append(r.blockIds, block.nextBlockId)
+    }
+
+    block, err := r.read(part)
+    if err != nil {
+        return err
+    }
+
+    // The block is copied as it may be a view of a memory mapping, which is unmapped when
+    // the storage is closed.
+    r.part = part
+    r.block = append(r.block[:0], block.bytes...)
+    return nil
+}
+
+func (r *EntryReader) read(part int) (Block, error) {
+    blockId := r.blockIds[part]
+    if blockId == EndOfEntry {
+        return Block{}, errors.New("premature end of entry")
+    }
+
+    // Every part but the last is full.
+    length := r.capacity
+    if remaining := r.ref.length - uint32(part)*r.capacity; remaining < length {
+        length = remaining
+    }
+
+    block, err := r.volume.readBlock(blockId, r.ref.id, length)
+    if err != nil {
+        return Block{}, err
+    }
+
+    if err := block.Validate(r.volume.storeId, r.ref.id, uint16(part)); err != nil {
+        return Block{}, err
+    }
+
+    return block, nil
+}
+
+// OpenWriter opens a writer for an entry. The entry is replaced once the writer is closed.
+func (v *Volume) OpenWriter(id uint32) (*EntryWriter, error) {
+    v.mutex.Lock()
+    defer v.mutex.Unlock()
+
+    first, err := v.reserveBlock()
+    if err != nil {
+        return nil, err
+    }
+
+    capacity := Capacity(id)
+    return &EntryWriter{
+        volume:   v,
+        blocks:   v.blocks,
+        id:       id,
+        capacity: capacity,
+        first:    first,
+        blockId:  first,
+        buffer:   make([]byte, 0, capacity),
+    }, nil
+}
+
+func (w *EntryWriter) Write(buffer []byte) (int, error) {
+    if w.closed {
+        return 0, WriterClosedError
+    }
+
+    written := 0
+    for len(buffer) > 0 {
+        // The current block is only written once more bytes arrive, as until then it is
+        // unknown whether it is the last block of the entry.
+        if w.pending {
+            if err := w.flush(); err != nil {
+                return written, err
+            }
+        }
+
+        n := copy(w.buffer[len(w.buffer):w.capacity], buffer)
+        w.buffer = w.buffer[:len(w.buffer)+n]
+        w.pending = uint32(len(w.buffer)) == w.capacity
+        w.length += uint32(n)
+
+        buffer = buffer[n:]
+        written += n
+    }
+
+    return written, nil
+}
+
+// Close writes the last block and updates the reference to point at the written entry.
+func (w *EntryWriter) Close() error {
+    if w.closed {
+        return WriterClosedError
+    }
+    w.closed = true
+
+    w.volume.mutex.Lock()
+    defer w.volume.mutex.Unlock()
+
+    if w.volume.blocks != w.blocks {
+        return StaleWriterError
+    }
+
+    var previous []uint32
+    if ref, err := w.volume.readReference(w.id); err == nil {
+        if previous, err = w.volume.chain(ref); err != nil {
+            return err
+        }
+    } else if err != io.EOF {
+        return err
+    }
+
+    if err := w.volume.writeBlock(Block{
+        id:          w.blockId,
+        volumeId:    w.volume.storeId,
+        entryId:     w.id,
+        part:        w.part,
+        nextBlockId: EndOfEntry,
+        bytes:       w.buffer,
+    }); err != nil {
+        return err
+    }
+
+    if err := w.volume.writeReference(Reference{
+        id:      w.id,
+        length:  w.length,
+        blockId: w.first,
+    }); err != nil {
+        return err
+    }
+
+    w.volume.notify(w.id)
+    return w.volume.allocator.release(w.volume, previous)
+}
+
+// flush writes the current full block, linking it to a newly reserved block.
+func (w *EntryWriter) flush() error {
+    w.volume.mutex.Lock()
+    defer w.volume.mutex.Unlock()
+
+    if w.volume.blocks != w.blocks {
+        return StaleWriterError
+    }
+
+    next, err := w.volume.reserveBlock()
+    if err != nil {
+        return err
+    }
+
+    if err := w.volume.writeBlock(Block{
+        id:          w.blockId,
+        volumeId:    w.volume.storeId,
+        entryId:     w.id,
+        part:        w.part,
+        nextBlockId: next,
+        bytes:       w.buffer,
+    }); err != nil {
+        return err
+    }
+
+    w.blockId = next
+    w.part++
+    w.buffer = w.buffer[:0]
+    w.pending = false
+    return nil
+}
+
+// reserveBlock claims a block which no entry owns by writing an empty block to it.
+func (v *Volume) reserveBlock() (uint32, error) {
+    ids, err := v.allocator.allocate(v, 1)
+    if err != nil {
+        return 0, err
+    }
+
+    if err := v.writeBlock(Block{id: ids[0]}); err != nil {
+        v.allocator.release(v, ids)
+        return 0, err
+    }
+
+    return ids[0], nil
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+    "testing"
+    "bytes"
+    "io"
+    "io/ioutil"
+    "os"
+    "sync"
+    "github.com/hadyn/goscape/internal"
+)
+
+func TestEntryReader(t *testing.T) {
+    volume := NewVolume(0, NewMemoryStore(nil), NewMemoryStore(nil), &sync.RWMutex{})
+
+    contents := internal.SequentialBytes(10000)
+    if err := volume.Write(70000, contents); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    reader, err := volume.OpenReader(70000)
+    if err != nil {
+        t.Fatal("failed to open the reader", err)
+    }
+
+    entry, err := ioutil.ReadAll(reader)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, contents) {
+        t.Error("contents mismatch")
+    }
+
+    for _, offset := range []int64{9999, 0, 5000, BytesPerExtendedBlock, BytesPerExtendedBlock - 1} {
+        if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+            t.Fatal("failed to seek", err)
+        }
+
+        buffer := make([]byte, 100)
+        n, err := io.ReadFull(reader, buffer)
+        if err != nil && err != io.ErrUnexpectedEOF {
+            t.Fatal("failed to read the entry", err)
+        }
+
+        if !bytes.Equal(buffer[:n], contents[offset:offset+int64(n)]) {
+            t.Errorf("contents mismatch at offset %d", offset)
+        }
+    }
+
+    if _, err := volume.OpenReader(1); err != EntryNotFoundError {
+        t.Errorf("expected entry not found error, got: %v", err)
+    }
+}
+
+func TestEntryWriter(t *testing.T) {
+    volume := NewVolume(0, NewMemoryStore(nil), NewMemoryStore(nil), &sync.RWMutex{})
+
+    if err := volume.Write(3, []byte("original")); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    contents := internal.SequentialBytes(BytesPerBlock * 4)
+
+    writer, err := volume.OpenWriter(3)
+    if err != nil {
+        t.Fatal("failed to open the writer", err)
+    }
+
+    // Write in uneven pieces that straddle the block boundaries.
+    for offset := 0; offset < len(contents); offset += 300 {
+        end := offset + 300
+        if end > len(contents) {
+            end = len(contents)
+        }
+
+        if _, err := writer.Write(contents[offset:end]); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    entry, err := volume.Read(3)
+    if err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, []byte("original")) {
+        t.Error("expected the original entry until the writer is closed")
+    }
+
+    if err := writer.Close(); err != nil {
+        t.Fatal("failed to close the writer", err)
+    }
+
+    if entry, err = volume.Read(3); err != nil {
+        t.Fatal("failed to read the entry", err)
+    }
+
+    if !bytes.Equal(entry, contents) {
+        t.Error("contents mismatch")
+    }
+
+    if _, err := writer.Write(contents); err != WriterClosedError {
+        t.Errorf("expected writer closed error, got: %v", err)
+    }
+}
+
+func TestEntryWriterCompacted(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    for id, contents := range []string{"zero", "one", "two"} {
+        if err := volume.Write(uint32(id), []byte(contents)); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    writer, err := volume.OpenWriter(2)
+    if err != nil {
+        t.Fatal("failed to open the writer", err)
+    }
+
+    if _, err := writer.Write(internal.SequentialBytes(BytesPerBlock + 1)); err != nil {
+        t.Fatal("failed to write the entry", err)
+    }
+
+    if _, err := storage.Compact(); err != nil {
+        t.Fatal("failed to compact the storage", err)
+    }
+
+    if err := writer.Close(); err != StaleWriterError {
+        t.Errorf("expected stale writer error, got: %v", err)
+    }
+
+    for id, contents := range []string{"zero", "one", "two"} {
+        entry, err := volume.Read(uint32(id))
+        if err != nil {
+            t.Fatal("failed to read the entry", err)
+        }
+
+        if !bytes.Equal(entry, []byte(contents)) {
+            t.Errorf("contents mismatch (expected: %s, actual: %s)", contents, entry)
+        }
+    }
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+    "fmt"
+    "io"
+    "hash/crc32"
+    "github.com/hadyn/goscape/container"
+)
+
+// Corruption describes a problem found with an entry while verifying a storage.
+type Corruption struct {
+    VolumeId uint8
+    EntryId  uint32
+    BlockId  uint32
+    Reason   string
+}
+
+func (c Corruption) Error() string {
+    return fmt.Sprintf("volume %d, entry %d, block %d: %s", c.VolumeId, c.EntryId, c.BlockId, c.Reason)
+}
+
+type blockOwner struct {
+    volumeId uint8
+    entryId  uint32
+}
+
+// Verify walks the block chain of every entry in every volume and reports chain cycles,
+// block header mismatches, references past the end of the blocks file, blocks claimed by
+// more than one entry and entries which do not match the CRC in their reference table.
+// The returned error is only non-nil if the storage could not be read.
+func (s *Storage) Verify() ([]Corruption, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    ids, err := s.indexes()
+    if err != nil {
+        return nil, err
+    }
+
+    length, err := s.blocks.Size()
+    if err != nil {
+        return nil, err
+    }
+
+    blockCount := uint32((length + BlockLength - 1) / BlockLength)
+
+    var tables *Volume
+    for _, id := range ids {
+        if id == ReferenceTableVolume {
+            if tables, err = s.open(id); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    var corruptions []Corruption
+    owners := make(map[uint32]blockOwner)
+
+    for _, id := range ids {
+        volume, err := s.open(id)
+        if err != nil {
+            return nil, err
+        }
+
+        found, err := verifyVolume(volume, tables, blockCount, owners)
+        if err != nil {
+            return nil, err
+        }
+
+        corruptions = append(corruptions, found...)
+    }
+
+    return corruptions, nil
+}
+
+// verifyVolume verifies every entry of a volume, recording which entry owns each block.
+func verifyVolume(volume *Volume, tables *Volume, blockCount uint32, owners map[uint32]blockOwner) ([]Corruption, error) {
+    length, err := volume.references.Size()
+    if err != nil {
+        return nil, err
+    }
+
+    // CRCs are only checked if the reference table can be decoded. A table whose chain is
+    // broken is reported when the reference table volume itself is verified, but a table
+    // which is read intact and fails to unpack or decode is reported here.
+    var table *ReferenceTable
+    var corruptions []Corruption
+    if tables != nil && volume.id != ReferenceTableVolume {
+        decoded, corruption, err := verifyTable(tables, volume.id)
+        if err != nil {
+            return nil, err
+        }
+
+        if corruption != nil {
+            corruptions = append(corruptions, *corruption)
+        }
+        table = decoded
+    }
+
+    count := uint32(length / ReferenceLength)
+    for entryId := uint32(0); entryId < count; entryId++ {
+        ref, err := volume.readReference(entryId)
+        if err != nil {
+            return nil, err
+        }
+
+        if ref.length == 0 || ref.blockId == EndOfEntry {
+            continue
+        }
+
+        entry, corruption, err := verifyChain(volume, ref, blockCount, owners)
+        if err != nil {
+            return nil, err
+        }
+
+        if corruption != nil {
+            corruptions = append(corruptions, *corruption)
+            continue
+        }
+
+        if table == nil {
+            continue
+        }
+
+        group := table.Group(entryId)
+        if group == nil {
+            continue
+        }
+
+        packed, err := container.PackedLength(entry)
+        if err != nil {
+            packed = len(entry)
+        }
+
+        if crc := crc32.ChecksumIEEE(entry[:packed]); crc != group.Crc {
+            corruptions = append(corruptions, Corruption{
+                VolumeId: volume.id,
+                EntryId:  entryId,
+                BlockId:  ref.blockId,
+                Reason:   fmt.Sprintf("crc mismatch (expected: %d, actual: %d)", group.Crc, crc),
+            })
+        }
+    }
+
+    return corruptions, nil
+}
+
+// verifyTable reads and decodes the reference table of a volume. Returns nil if the table
+// does not exist or could not be read, and a corruption if it could not be decoded.
+func verifyTable(tables *Volume, id uint8) (*ReferenceTable, *Corruption, error) {
+    exists, err := tables.contains(uint32(id))
+    if err != nil || !exists {
+        return nil, nil, err
+    }
+
+    buffer, err := tables.read(uint32(id))
+    if err != nil {
+        return nil, nil, nil
+    }
+
+    ref, err := tables.readReference(uint32(id))
+    if err != nil {
+        return nil, nil, err
+    }
+
+    corrupt := func(format string, args ...interface{}) (*ReferenceTable, *Corruption, error) {
+        return nil, &Corruption{
+            VolumeId: ReferenceTableVolume,
+            EntryId:  uint32(id),
+            BlockId:  ref.blockId,
+            Reason:   fmt.Sprintf(format, args...),
+        }, nil
+    }
+
+    unpacked, err := container.Unpack(buffer)
+    if err != nil {
+        return corrupt("failed to unpack the reference table: %s", err)
+    }
+
+    table, err := DecodeReferenceTable(unpacked)
+    if err != nil {
+        return corrupt("failed to decode the reference table: %s", err)
+    }
+
+    return table, nil, nil
+}
+
+// verifyChain follows the block chain of an entry, returning the entry if it is intact.
+func verifyChain(volume *Volume, ref Reference, blockCount uint32, owners map[uint32]blockOwner) ([]byte, *Corruption, error) {
+    corrupt := func(blockId uint32, format string, args ...interface{}) ([]byte, *Corruption, error) {
+        return nil, &Corruption{
+            VolumeId: volume.id,
+            EntryId:  ref.id,
+            BlockId:  blockId,
+            Reason:   fmt.Sprintf(format, args...),
+        }, nil
+    }
+
+    owner := blockOwner{volume.id, ref.id}
+    capacity := Capacity(ref.id)
+    visited := make(map[uint32]bool)
+    buffer := make([]byte, ref.length)
+
+    blockId := ref.blockId
+    offset := uint32(0)
+    for part := uint16(0); offset < ref.length; part++ {
+        if blockId == EndOfEntry {
+            return corrupt(blockId, "premature end of entry")
+        }
+
+        if blockId >= blockCount {
+            return corrupt(blockId, "block is past the end of the blocks file (blocks: %d)", blockCount)
+        }
+
+        if visited[blockId] {
+            return corrupt(blockId, "block chain contains a cycle")
+        }
+        visited[blockId] = true
+
+        if other, ok := owners[blockId]; ok && other != owner {
+            return corrupt(blockId, "block is also claimed by volume %d, entry %d", other.volumeId, other.entryId)
+        }
+        owners[blockId] = owner
+
+        read := ref.length - offset
+        if read > capacity {
+            read = capacity
+        }
+
+        block, err := volume.readBlock(blockId, ref.id, read)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return corrupt(blockId, "block is cut short by the end of the blocks file")
+        }
+
+        if err != nil {
+            return nil, nil, err
+        }
+
+        if err := block.Validate(volume.storeId, ref.id, part); err != nil {
+            return corrupt(blockId, "%s", err)
+        }
+
+        copy(buffer[offset:], block.bytes[:read])
+        offset += read
+        blockId = block.nextBlockId
+    }
+
+    return buffer, nil, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+    "testing"
+    "io/ioutil"
+    "os"
+    "strings"
+    "github.com/hadyn/goscape/container"
+    "github.com/hadyn/goscape/internal"
+)
+
+func TestStorageVerify(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    volume, err := storage.Open(0)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    packed, err := container.Pack(internal.SequentialBytes(2000), container.None)
+    if err != nil {
+        t.Fatal("failed to pack the entry", err)
+    }
+
+    for id := uint32(0); id < 4; id++ {
+        if err := volume.Write(id, packed); err != nil {
+            t.Fatal("failed to write the entry", err)
+        }
+    }
+
+    // The reference table only knows the correct CRC of the first entry.
+    table := &ReferenceTable{Format: RevisionedFormat}
+    for id := uint32(0); id < 4; id++ {
+        table.Groups = append(table.Groups, &GroupReference{Id: id, Children: []*ChildReference{{}}})
+    }
+    table.Groups[0].Crc = 0x2EBFFE2E
+
+    if err := storage.WriteReferenceTable(0, table, container.None); err != nil {
+        t.Fatal("failed to write the table", err)
+    }
+
+    // Point the second entry at the blocks of the first, and the third past the end.
+    first, _ := volume.readReference(0)
+    if err := volume.writeReference(Reference{1, first.length, first.blockId}); err != nil {
+        t.Fatal("failed to write the reference", err)
+    }
+
+    if err := volume.writeReference(Reference{2, first.length, 1000}); err != nil {
+        t.Fatal("failed to write the reference", err)
+    }
+
+    corruptions, err := storage.Verify()
+    if err != nil {
+        t.Fatal("failed to verify the storage", err)
+    }
+
+    expected := map[uint32]string{
+        1: "block is also claimed",
+        2: "past the end",
+        3: "crc mismatch",
+    }
+
+    if len(corruptions) != len(expected) {
+        t.Fatalf("corruption count mismatch (expected: %d, actual: %d): %v", len(expected), len(corruptions), corruptions)
+    }
+
+    for _, corruption := range corruptions {
+        if corruption.VolumeId != 0 || !strings.Contains(corruption.Reason, expected[corruption.EntryId]) {
+            t.Errorf("unexpected corruption: %s", corruption.Error())
+        }
+    }
+}
+
+func TestStorageVerifyCorruptTable(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tmp")
+    if err != nil {
+        t.Fatal("failed to open the directory", err)
+    }
+
+    defer os.RemoveAll(dir)
+
+    storage, err := NewStorage(dir, testProvider{}, ReadWrite)
+    if err != nil {
+        t.Fatal("failed to open the storage", err)
+    }
+
+    defer storage.Close()
+
+    for _, id := range []uint8{0, 1} {
+        if _, err := storage.Open(id); err != nil {
+            t.Fatal("failed to open the volume", err)
+        }
+    }
+
+    tables, err := storage.Open(ReferenceTableVolume)
+    if err != nil {
+        t.Fatal("failed to open the volume", err)
+    }
+
+    // The table is packed intact, but its format is not supported.
+    packed, err := container.Pack([]byte{99, 0, 0, 0}, container.None)
+    if err != nil {
+        t.Fatal("failed to pack the table", err)
+    }
+
+    if err := tables.Write(0, packed); err != nil {
+        t.Fatal("failed to write the table", err)
+    }
+
+    // The container header claims a far longer payload than the table holds.
+    if err := tables.Write(1, []byte{0, 0x7F, 0, 0, 0, 1, 2, 3}); err != nil {
+        t.Fatal("failed to write the table", err)
+    }
+
+    corruptions, err := storage.Verify()
+    if err != nil {
+        t.Fatal("failed to verify the storage", err)
+    }
+
+    if len(corruptions) != 2 {
+        t.Fatalf("corruption count mismatch (expected: %d, actual: %d): %v", 2, len(corruptions), corruptions)
+    }
+
+    expected := map[uint32]string{0: "decode", 1: "unpack"}
+    for _, corruption := range corruptions {
+        if corruption.VolumeId != ReferenceTableVolume || !strings.Contains(corruption.Reason, expected[corruption.EntryId]) {
+            t.Errorf("unexpected corruption: %s", corruption.Error())
+        }
+    }
+}
@@ -1,41 +1,57 @@
 package storage
 
 import (
-    "os"
+    "io"
     "sync"
     "github.com/hadyn/goscape/types"
     "errors"
-    "fmt"
+)
+
+var (
+    EntryNotFoundError = errors.New("entry not found")
 )
 
 type Volume struct {
     id         uint8
-    references *os.File
-    blocks     *os.File
-    mutex      *sync.Mutex
+    storeId    uint8
+    references Store
+    blocks     Store
+    mutex      *sync.RWMutex
+    watchers   *watchers
+    allocator  *allocator
 }
 
-func NewVolume(id uint8, references *os.File, blocks *os.File, mutex *sync.Mutex) *Volume {
+func NewVolume(id uint8, references Store, blocks Store, mutex *sync.RWMutex) *Volume {
     return &Volume{
         id:         id,
+        storeId:    id,
         references: references,
         blocks:     blocks,
         mutex:      mutex,
+        watchers:   &watchers{},
+        allocator:  newAllocator(nil),
     }
 }
 
-func (v Volume) Read(id uint16) ([]byte, error) {
-    v.mutex.Lock()
-    defer v.mutex.Unlock()
+func (v *Volume) Read(id uint32) ([]byte, error) {
+    v.mutex.RLock()
+    defer v.mutex.RUnlock()
 
+    return v.read(id)
+}
+
+// read reads an entry, failing with EntryNotFoundError if it does not exist or has been
+// deleted, and with io.ErrUnexpectedEOF if the blocks file ends before the entry does.
+func (v *Volume) read(id uint32) ([]byte, error) {
     // Read the reference.
-    ref, err := v.readReference(id)
+    ref, err := v.reference(id)
     if err != nil {
         return nil, err
     }
 
     length := uint32(ref.length)
     buffer := make([]byte, length)
+    capacity := Capacity(id)
 
     // Begin reading the entry.
     blockId := ref.blockId
@@ -45,24 +61,28 @@ func (v Volume) Read(id uint16) ([]byte, error) {
             return nil, errors.New("premature end of entry")
         }
 
-        block, err := v.readBlock(blockId)
+        // Determine how many bytes to read this pass.
+        read := length - offset
+        if read > capacity {
+            read = capacity
+        }
+
+        block, err := v.readBlock(blockId, id, read)
+        if err == io.EOF {
+            return nil, io.ErrUnexpectedEOF
+        }
+
         if err != nil {
             return nil, err
         }
 
         // Validate the block to make sure the entry is not corrupted or invalid.
-        if err := block.Validate(v.id, id, part); err != nil {
+        if err := block.Validate(v.storeId, id, part); err != nil {
             return nil, err
         }
 
         blockId = block.nextBlockId
 
-        // Determine how many bytes to read this pass.
-        read := length - offset
-        if read > BytesPerBlock {
-            read = BytesPerBlock
-        }
-
         copy(buffer[offset:], block.bytes[:read])
         offset += read
     }
@@ -70,138 +90,208 @@ func (v Volume) Read(id uint16) ([]byte, error) {
     return buffer, nil
 }
 
-func (v Volume) Write(id uint16, buffer []byte) error {
+// Write writes an entry. The entry is written to blocks which no entry owns, and the
+// reference is only switched over to them once every block has been written, so the
+// previous entry remains intact if writing fails part way through. The blocks of the
+// previous entry are then reused by later writes.
+func (v *Volume) Write(id uint32, buffer []byte) error {
     v.mutex.Lock()
     defer v.mutex.Unlock()
 
-    // First attempt to overwrite the entry if it exists and is valid,
-    // otherwise append the entry.
-    if err := v.write(id, buffer, true); err != nil {
-        return v.write(id, buffer, false)
+    if err := v.write(id, buffer); err != nil {
+        return err
     }
 
+    v.notify(id)
     return nil
 }
 
-func (v Volume) write(id uint16, buffer []byte, overwrite bool) error {
-    length := uint32(len(buffer))
+// Delete removes an entry by zeroing its reference. If free is set the blocks of the entry
+// are zeroed as well so they no longer hold its contents. Either way the blocks are reused
+// by later writes.
+func (v *Volume) Delete(id uint32, free bool) error {
+    v.mutex.Lock()
+    defer v.mutex.Unlock()
 
-    // Determine the next block identifier depending if we are overwriting the entry.
-    var blockId uint32
-    if overwrite {
-        ref, err := v.readReference(id)
-        if err != nil {
-            return err
-        }
+    ref, err := v.reference(id)
+    if err != nil {
+        return err
+    }
 
-        if exists, err := v.blockExists(ref.blockId); !exists || err != nil {
-            if err != nil {
+    if err := v.writeReference(Reference{id: id}); err != nil {
+        return err
+    }
+
+    v.notify(id)
+
+    // Only the blocks which still belong to the entry are zeroed and reused.
+    blockIds, err := v.chain(ref)
+    if err != nil {
+        return err
+    }
+
+    if free {
+        for _, blockId := range blockIds {
+            if err := v.writeBlock(Block{id: blockId}); err != nil {
                 return err
             }
-            return errors.New(fmt.Sprintf("block %d does not exist", ref.blockId))
         }
+    }
 
-        blockId = ref.blockId
-    } else {
-        nextBlockId, err := v.nextBlockId()
-        if err != nil {
-            return err
-        }
+    return v.allocator.release(v, blockIds)
+}
+
+// Exists returns whether the volume holds an entry.
+func (v *Volume) Exists(id uint32) (bool, error) {
+    v.mutex.RLock()
+    defer v.mutex.RUnlock()
+
+    return v.contains(id)
+}
+
+// Length returns the length of an entry without reading it.
+func (v *Volume) Length(id uint32) (uint32, error) {
+    v.mutex.RLock()
+    defer v.mutex.RUnlock()
 
-        blockId = nextBlockId
+    ref, err := v.reference(id)
+    if err != nil {
+        return 0, err
     }
+    return ref.length, nil
+}
 
-    // Update the reference.
-    if err := v.writeReference(Reference{
-        id:      id,
-        length:  length,
-        blockId: blockId,
-    }); err != nil {
+// Count returns the number of references in the volume, including those of entries which
+// do not exist.
+func (v *Volume) Count() (uint32, error) {
+    v.mutex.RLock()
+    defer v.mutex.RUnlock()
+
+    return v.count()
+}
+
+func (v *Volume) write(id uint32, buffer []byte) error {
+    var previous []uint32
+    if ref, err := v.readReference(id); err == nil {
+        if previous, err = v.chain(ref); err != nil {
+            return err
+        }
+    } else if err != io.EOF {
         return err
     }
 
-    // Begin writing the entry.
-    offset := uint32(0)
-    for part := uint16(0); offset < length; part++ {
-        nextBlockId := uint32(EndOfEntry)
-
-        // If we are overwriting, determine the next block identifier and check that
-        // the block/next block is valid.
-        if overwrite {
-            block, err := v.readBlock(blockId)
-            if err != nil {
-                return err
-            }
+    ref, blockIds, err := v.writeBlocks(id, buffer)
+    if err != nil {
+        return err
+    }
 
-            if err := block.Validate(v.id, id, part); err != nil {
-                return err
-            }
+    // The reference is only updated once every block has been written so that it never
+    // points at a partially written entry.
+    if err := v.writeReference(ref); err != nil {
+        v.allocator.release(v, blockIds)
+        return err
+    }
 
-            if exists, err := v.blockExists(block.nextBlockId); !exists || err != nil {
-                if err != nil {
-                    return err
-                }
-                return errors.New(fmt.Sprintf("block %d does not exist", block.nextBlockId))
-            }
+    // The previous reference may be corrupt and share blocks with the new entry.
+    written := make(map[uint32]bool)
+    for _, blockId := range blockIds {
+        written[blockId] = true
+    }
 
-            nextBlockId = block.nextBlockId
+    var orphaned []uint32
+    for _, blockId := range previous {
+        if !written[blockId] {
+            orphaned = append(orphaned, blockId)
         }
+    }
 
-        // Special case when we are not overwriting and or we reached
-        // the end of the entry. Determine the next block identifier
-        // from the end of the blocks file.
-        if nextBlockId == EndOfEntry {
-            freeBlockId, err := v.nextBlockId()
-            if err != nil {
-                return err
-            }
+    return v.allocator.release(v, orphaned)
+}
 
-            if blockId == freeBlockId {
-                freeBlockId++
-            }
+// writeBlocks writes the blocks of an entry to blocks which no entry owns, and returns the
+// reference to the entry and the blocks it was written to without writing the reference.
+// Blocks are reused before any are appended to the end of the blocks file.
+func (v *Volume) writeBlocks(id uint32, buffer []byte) (Reference, []uint32, error) {
+    length := uint32(len(buffer))
+    capacity := Capacity(id)
 
-            nextBlockId = freeBlockId
-            overwrite = false
-        }
+    blockIds, err := v.allocator.allocate(v, blockCount(length, capacity))
+    if err != nil {
+        return Reference{}, nil, err
+    }
 
+    // Begin writing the entry.
+    for part := range blockIds {
         // Determine how many bytes we are writing this pass.
+        offset := uint32(part) * capacity
         write := length - offset
-        if write <= BytesPerBlock {
-            nextBlockId = EndOfEntry
-        }
-
-        if write > BytesPerBlock {
-            write = BytesPerBlock
+        nextBlockId := uint32(EndOfEntry)
+        if write > capacity {
+            write = capacity
+            nextBlockId = blockIds[part+1]
         }
 
         // Write the block.
         err := v.writeBlock(Block{
-            id:          blockId,
-            volumeId:    v.id,
+            id:          blockIds[part],
+            volumeId:    v.storeId,
             entryId:     id,
-            part:        part,
+            part:        uint16(part),
             nextBlockId: nextBlockId,
             bytes:       buffer[offset : offset+write],
         })
 
         if err != nil {
-            return err
+            v.allocator.release(v, blockIds)
+            return Reference{}, nil, err
         }
-
-        blockId = nextBlockId
-        offset += write
     }
 
-    return nil
+    return Reference{
+        id:      id,
+        length:  length,
+        blockId: blockIds[0],
+    }, blockIds, nil
 }
 
-func (v Volume) readReference(id uint16) (Reference, error) {
-    if _, err := v.references.Seek(int64(id*ReferenceLength), 0); err != nil {
-        return Reference{}, err
+// chain returns the blocks of an entry, stopping at the first block which does not belong
+// to it.
+func (v *Volume) chain(ref Reference) ([]uint32, error) {
+    var blockIds []uint32
+    blockId := ref.blockId
+    count := blockCount(ref.length, Capacity(ref.id))
+    for part := 0; part < count && blockId != EndOfEntry; part++ {
+        block, err := v.readBlock(blockId, ref.id, 0)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        }
+
+        if err != nil {
+            return nil, err
+        }
+
+        if block.Validate(v.storeId, ref.id, uint16(part)) != nil {
+            break
+        }
+
+        blockIds = append(blockIds, blockId)
+        blockId = block.nextBlockId
     }
+    return blockIds, nil
+}
 
+// blockCount returns the number of blocks an entry is written to. An empty entry still
+// takes a block.
+func blockCount(length uint32, capacity uint32) int {
+    if length == 0 {
+        return 1
+    }
+    return int((length + capacity - 1) / capacity)
+}
+
+func (v *Volume) readReference(id uint32) (Reference, error) {
     buffer := make([]byte, ReferenceLength)
-    if _, err := v.references.Read(buffer); err != nil {
+    if _, err := v.references.ReadAt(buffer, int64(id)*ReferenceLength); err != nil {
         return Reference{}, err
     }
 
@@ -212,76 +302,100 @@ func (v Volume) readReference(id uint16) (Reference, error) {
     }, nil
 }
 
-func (v Volume) writeReference(ref Reference) error {
-    if _, err := v.references.Seek(int64(ref.id*ReferenceLength), 0); err != nil {
-        return err
-    }
-
+func (v *Volume) writeReference(ref Reference) error {
     buffer := make([]byte, ReferenceLength)
     ref.Write(buffer)
 
-    if _, err := v.references.Write(buffer); err != nil {
+    if _, err := v.references.WriteAt(buffer, int64(ref.id)*ReferenceLength); err != nil {
         return err
     }
 
     return nil
 }
 
-func (v Volume) readBlock(id uint32) (Block, error) {
-    if _, err := v.blocks.Seek(int64(id*BlockLength), 0); err != nil {
-        return Block{}, err
+// readBlock reads a block, requiring its header and the given number of bytes of its
+// payload. The client only writes as much of the last block of the blocks file as it
+// needs, so the file may end part way through a block, in which case the rest of the
+// block reads as zeroes.
+func (v *Volume) readBlock(id uint32, entryId uint32, length uint32) (Block, error) {
+    required := int(BlockLength - Capacity(entryId) + length)
+
+    var buffer []byte
+    var n int
+    var err error
+
+    // Avoid copying the block if the blocks file is memory mapped.
+    if mapped, ok := v.blocks.(*mappedFile); ok {
+        buffer, n, err = mapped.slice(int64(id)*BlockLength, BlockLength)
+    } else {
+        buffer = make([]byte, BlockLength)
+        n, err = v.blocks.ReadAt(buffer, int64(id)*BlockLength)
     }
 
-    buffer := make([]byte, BlockLength)
-    if _, err := v.blocks.Read(buffer); err != nil {
-        return Block{}, err
+    if err == io.EOF && n >= required {
+        err = nil
     }
 
-    return Block{
-        id:          id,
-        volumeId:    buffer[7],
-        entryId:     types.BigEndian.Uint16(buffer[0:]),
-        part:        types.BigEndian.Uint16(buffer[2:]),
-        nextBlockId: types.BigEndian.Uint24(buffer[4:]),
-        bytes:       buffer[BlockHeaderLength:],
-    }, nil
+    if err != nil {
+        return Block{}, err
+    }
 
+    return ReadBlock(id, entryId, buffer), nil
 }
 
-func (v Volume) writeBlock(block Block) error {
-    if _, err := v.blocks.Seek(int64(block.id*BlockLength), 0); err != nil {
-        return err
-    }
-
+func (v *Volume) writeBlock(block Block) error {
     buffer := make([]byte, BlockLength)
     block.Write(buffer)
 
-    if _, err := v.blocks.Write(buffer); err != nil {
+    if _, err := v.blocks.WriteAt(buffer, int64(block.id)*BlockLength); err != nil {
         return err
     }
 
     return nil
 }
 
-func (v Volume) blockExists(id uint32) (bool, error) {
-    stat, err := v.blocks.Stat()
+func (v *Volume) nextBlockId() (uint32, error) {
+    size, err := v.blocks.Size()
     if err != nil {
-        return false, err
+        return 0, err
     }
 
-    return id > EndOfEntry && id <= uint32(stat.Size()/BlockLength), nil
+    id := uint32((size + BlockLength - 1) / BlockLength)
+    if id == EndOfEntry {
+        id++
+    }
+
+    return id, nil
 }
 
-func (v Volume) nextBlockId() (uint32, error) {
-    stat, err := v.blocks.Stat()
+// reference reads the reference of an entry, failing if the entry does not exist.
+func (v *Volume) reference(id uint32) (Reference, error) {
+    ref, err := v.readReference(id)
+    if err == io.EOF || (err == nil && ref.blockId == EndOfEntry) {
+        return Reference{}, EntryNotFoundError
+    }
+    return ref, err
+}
+
+// contains returns whether the volume holds an entry.
+func (v *Volume) contains(id uint32) (bool, error) {
+    ref, err := v.readReference(id)
     if err != nil {
-        return 0, err
+        if err == io.EOF {
+            return false, nil
+        }
+        return false, err
     }
 
-    id := uint32((stat.Size() + BlockLength - 1) / BlockLength)
-    if id == EndOfEntry {
-        id++
+    return ref.blockId != EndOfEntry, nil
+}
+
+// count returns the number of references in the volume.
+func (v *Volume) count() (uint32, error) {
+    size, err := v.references.Size()
+    if err != nil {
+        return 0, err
     }
 
-    return id, nil
+    return uint32(size / ReferenceLength), nil
 }
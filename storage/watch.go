@@ -0,0 +1,31 @@
+package storage
+
+import (
+    "sync"
+)
+
+// watchers holds the functions watching a volume for changes.
+type watchers struct {
+    mutex sync.RWMutex
+    funcs []func(id uint32)
+}
+
+// Watch registers a function which is called with the identifier of every entry written
+// to or deleted from the volume. The function is called while the volume is locked, so it
+// must not use the volume.
+func (v *Volume) Watch(watcher func(id uint32)) {
+    v.watchers.mutex.Lock()
+    defer v.watchers.mutex.Unlock()
+
+    v.watchers.funcs = append(v.watchers.funcs, watcher)
+}
+
+// notify calls every watcher of the volume with the identifier of a changed entry.
+func (v *Volume) notify(id uint32) {
+    v.watchers.mutex.RLock()
+    defer v.watchers.mutex.RUnlock()
+
+    for _, watcher := range v.watchers.funcs {
+        watcher(id)
+    }
+}